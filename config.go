@@ -0,0 +1,329 @@
+//
+// Copyright (c) 2015 Lorenzo Villani
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ungerik/go-dry"
+)
+
+//
+// Configuration file
+//
+
+const configName = ".metafmt.toml"
+
+// Config is the contents of a .metafmt.toml file.
+type Config struct {
+	AppendNewline bool     // Like -append-newline
+	Extras        []string // Names of the optional formatter steps to run
+	Override      []Override
+}
+
+// Override changes the formatter used for files matching Path, a slash-separated glob relative
+// to the directory containing the configuration file ("**" matches any number of directories),
+// or for files with one of Extensions. Language selects another built-in formatter for them,
+// for instance when an extension is used by several languages. Then, only the fields that are
+// set replace those of the formatter; setting Enabled to false leaves the matching files alone.
+type Override struct {
+	Path           string
+	Extensions     []string
+	Enabled        *bool
+	Language       string
+	Commands       [][]string
+	Validators     [][]string
+	AdditionalArgs []string
+	Native         string
+	Shell          *bool
+}
+
+var config Config
+var configDir string
+
+// loadConfig reads the first .metafmt.toml found in the current directory or one of its parents.
+func loadConfig() error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	for {
+		configPath := filepath.Join(dir, configName)
+
+		if _, err := os.Stat(configPath); err == nil {
+			if _, err := toml.DecodeFile(configPath, &config); err != nil {
+				return err
+			}
+
+			for _, override := range config.Override {
+				if override.Language != "" && formatterForLanguage(override.Language) == nil {
+					return fmt.Errorf("%s: unknown language %q", configPath, override.Language)
+				}
+
+				if _, ok := natives[override.Native]; override.Native != "" && !ok {
+					return fmt.Errorf("%s: unknown native formatter %q", configPath, override.Native)
+				}
+
+				if hasEmptyCommand(override.Commands) || hasEmptyCommand(override.Validators) {
+					return fmt.Errorf("%s: commands can't be empty", configPath)
+				}
+			}
+
+			configDir = dir
+			return nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+
+		dir = parent
+	}
+}
+
+func overrideForPath(filePath string) *Override {
+	if configDir == "" {
+		return nil
+	}
+
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil
+	}
+
+	rel, err := filepath.Rel(configDir, abs)
+	if err != nil {
+		return nil
+	}
+
+	rel = filepath.ToSlash(rel)
+	exts := extensions(filePath)
+
+	for i := range config.Override {
+		override := &config.Override[i]
+
+		if override.Path != "" && matchGlob(override.Path, rel) {
+			return override
+		}
+
+		for _, ext := range exts {
+			if dry.StringListContains(override.Extensions, ext) {
+				return override
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasEmptyCommand reports whether one of commands has no program to run.
+func hasEmptyCommand(commands [][]string) bool {
+	for _, command := range commands {
+		if len(command) == 0 || command[0] == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o *Override) apply(f *formatter) *formatter {
+	if o.disabled() {
+		return nil
+	}
+
+	if o.Language != "" {
+		f = formatterForLanguage(o.Language)
+	}
+
+	var result formatter
+	if f != nil {
+		result = *f
+	}
+
+	if o.Commands != nil {
+		result.Commands = o.Commands
+		result.Fallbacks = nil
+		result.LineWidthFlag = ""
+		result.LocalFlag = ""
+		result.NativeFunc = nil
+	}
+
+	if o.Shell != nil {
+		result.Shell = *o.Shell
+	}
+
+	if o.Native != "" {
+		result.NativeFunc = natives[o.Native]
+	}
+
+	if o.Validators != nil {
+		result.Validators = o.Validators
+	}
+
+	if o.AdditionalArgs != nil {
+		result.AdditionalArgs = o.AdditionalArgs
+	}
+
+	if len(result.Commands) == 0 && result.NativeFunc == nil {
+		return nil
+	}
+
+	return &result
+}
+
+func (o *Override) disabled() bool {
+	return o.Enabled != nil && !*o.Enabled
+}
+
+//
+// Plugins
+//
+
+// FormatterConfig describes a formatter defined outside of the binary.
+type FormatterConfig struct {
+	Name            string
+	Extensions      []string
+	EmacsMajorModes commaList
+	Commands        [][]string
+	Shell           bool
+}
+
+// commaList is a list of strings that can also be written in TOML as a single comma-separated
+// string, as in "go-mode, go-ts-mode".
+type commaList []string
+
+func (l *commaList) UnmarshalTOML(value interface{}) error {
+	switch value := value.(type) {
+	case string:
+		*l = nil
+
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*l = append(*l, item)
+			}
+		}
+	case []interface{}:
+		*l = make(commaList, len(value))
+
+		for i, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %T", item)
+			}
+
+			(*l)[i] = s
+		}
+	default:
+		return fmt.Errorf("expected a string or a list of strings, got %T", value)
+	}
+
+	return nil
+}
+
+// loadPlugins registers the formatters described by the TOML files in the plugins directory
+// of the user's configuration directory (~/.config/metafmt/plugins on Linux). Plugins take
+// precedence over built-in formatters.
+func loadPlugins() error {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "metafmt", "plugins", "*.toml"))
+	if err != nil {
+		return err
+	}
+
+	for _, pluginPath := range paths {
+		var plugin FormatterConfig
+
+		if _, err := toml.DecodeFile(pluginPath, &plugin); err != nil {
+			return err
+		}
+
+		if len(plugin.Commands) == 0 {
+			return fmt.Errorf("%s: formatter %q has no commands", pluginPath, plugin.Name)
+		}
+
+		if hasEmptyCommand(plugin.Commands) {
+			return fmt.Errorf("%s: formatter %q has an empty command", pluginPath, plugin.Name)
+		}
+
+		formatter := &formatter{
+			Language:        plugin.Name,
+			Commands:        plugin.Commands,
+			EmacsMajorModes: plugin.EmacsMajorModes,
+			Extensions:      plugin.Extensions,
+			Shell:           plugin.Shell,
+		}
+
+		formatters = append(formatters, formatter)
+		register(formatter)
+	}
+
+	return nil
+}
+
+//
+// Glob matching
+//
+
+// matchGlob reports whether the slash-separated name matches pattern. Besides the syntax
+// understood by path.Match, a "**" path segment matches zero or more directories.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
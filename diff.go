@@ -0,0 +1,302 @@
+//
+// Copyright (c) 2015 Lorenzo Villani
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//
+// Unified diffs
+//
+
+const diffContext = 3
+
+// maxDiffLines is how many lines, left once those a and b have in common at their beginning and
+// end are put aside, unifiedDiff compares at most. Past that, it only says that they differ.
+const maxDiffLines = 50000
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line []byte
+}
+
+// unifiedDiff returns the differences between a and b in unified format, or nil when they are
+// equal. When too many lines differ, it returns a message saying so instead.
+func unifiedDiff(aName, bName string, a, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+
+	aLines, bLines := splitLines(a), splitLines(b)
+
+	if prefix, suffix := commonLines(aLines, bLines); len(aLines)+len(bLines)-2*(prefix+suffix) > maxDiffLines {
+		return []byte(fmt.Sprintf("--- %s\n+++ %s\nFiles differ, too many lines changed to show\n", aName, bName))
+	}
+
+	ops := diffLines(aLines, bLines)
+
+	// Line numbers of the first line of a and b at or after each operation
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Grow the hunk until the next change is too far away to share context
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+
+			if next == len(ops) || next-end > 2*diffContext {
+				end += diffContext
+				if end > len(ops) {
+					end = len(ops)
+				}
+
+				break
+			}
+
+			end = next
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(aPos[start], aPos[end]-aPos[start]),
+			hunkRange(bPos[start], bPos[end]-bPos[start]))
+
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.Write(op.line)
+
+			if !bytes.HasSuffix(op.line, []byte("\n")) {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return out.Bytes()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(data []byte) [][]byte {
+	if len(data) == 0 {
+		return nil
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// diffLines computes a shortest edit script turning a into b with the linear space variant of
+// Myers' algorithm.
+func diffLines(a, b [][]byte) []diffOp {
+	var ops []diffOp
+	diffRange(&ops, a, b)
+	return ops
+}
+
+// commonLines returns the number of lines a and b have in common at their beginning and, in what
+// remains, at their end.
+func commonLines(a, b [][]byte) (prefix, suffix int) {
+	for prefix < len(a) && prefix < len(b) && bytes.Equal(a[prefix], b[prefix]) {
+		prefix++
+	}
+
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		bytes.Equal(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+
+	return prefix, suffix
+}
+
+// diffRange appends the edit script turning a into b to ops. It splits the lines that differ in
+// two, where the paths searched from both ends meet, and recurses on each half.
+func diffRange(ops *[]diffOp, a, b [][]byte) {
+	prefix, suffix := commonLines(a, b)
+
+	for _, line := range a[:prefix] {
+		*ops = append(*ops, diffOp{' ', line})
+	}
+
+	changedA, changedB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	if x, y, ok := bisect(changedA, changedB); ok {
+		diffRange(ops, changedA[:x], changedB[:y])
+		diffRange(ops, changedA[x:], changedB[y:])
+	} else {
+		for _, line := range changedA {
+			*ops = append(*ops, diffOp{'-', line})
+		}
+
+		for _, line := range changedB {
+			*ops = append(*ops, diffOp{'+', line})
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		*ops = append(*ops, diffOp{' ', line})
+	}
+}
+
+// bisect searches for the shortest edit script turning a into b from both ends at once, keeping
+// only the furthest point reached on each diagonal, and returns where the two searches meet. It
+// returns false when a or b is empty, or when they have no line in common.
+func bisect(a, b [][]byte) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+
+	maxD := (n + m + 1) / 2
+	offset := maxD
+
+	// vf[offset+k] is the furthest x reached on diagonal k from the beginning, vb[offset+k] the
+	// furthest distance from the end reached on diagonal k counted from the end, -1 if none
+	vf := make([]int, 2*maxD+2)
+	vb := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+
+	vf[offset+1], vb[offset+1] = 0, 0
+
+	delta := n - m
+	front := delta%2 != 0
+
+	// The diagonals, at either end of the range, whose path went past the end of a or b
+	var fStart, fEnd, bStart, bEnd int
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+
+			var x int
+			if k == -d || (k != d && vf[i-1] < vf[i+1]) {
+				x = vf[i+1]
+			} else {
+				x = vf[i-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+
+			vf[i] = x
+
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case front:
+				if j := offset + delta - k; j >= 0 && j < len(vb) && vb[j] != -1 && x >= n-vb[j] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			i := offset + k
+
+			var x int
+			if k == -d || (k != d && vb[i-1] < vb[i+1]) {
+				x = vb[i+1]
+			} else {
+				x = vb[i-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[n-1-x], b[m-1-y]) {
+				x++
+				y++
+			}
+
+			vb[i] = x
+
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !front:
+				if j := offset + delta - k; j >= 0 && j < len(vf) && vf[j] != -1 && vf[j] >= n-x {
+					return vf[j], vf[j] - (j - offset), true
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
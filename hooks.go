@@ -0,0 +1,252 @@
+//
+// Copyright (c) 2015 Lorenzo Villani
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//
+// Hooks
+//
+
+// generatePreCommitHooks writes a .pre-commit-hooks.yaml for the pre-commit framework, with one
+// hook per formatter matching the files of the extensions handled by that formatter.
+func generatePreCommitHooks(w io.Writer) error {
+	for _, formatter := range formatters {
+		exts := hookExtensions(formatter)
+		if len(exts) == 0 {
+			continue
+		}
+
+		entry := "metafmt -write"
+		if formatter.Experimental {
+			entry += " -experimental"
+		}
+
+		_, err := fmt.Fprintf(w, `- id: metafmt-%s
+  name: metafmt (%s)
+  description: Format %s files with %s
+  entry: %s
+  language: system
+  files: '%s'
+`, hookID(formatter.Language), formatter.Language, formatter.Language, hookTools(formatter), entry, hookFilesPattern(exts))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hookExtensions returns the extensions for which formatter is the one metafmt uses, leaving out
+// those claimed by a formatter registered later, and formatters that can't format anything yet.
+func hookExtensions(formatter *formatter) []string {
+	if !formatter.canFormat() {
+		return nil
+	}
+
+	var exts []string
+	for _, ext := range formatter.Extensions {
+		if extToFormatter[ext] == formatter {
+			exts = append(exts, ext)
+		}
+	}
+
+	return exts
+}
+
+var nonHookIDChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// hookID turns a language name into a hook identifier, as in "c-cpp" for "C/C++".
+func hookID(language string) string {
+	id := strings.Replace(strings.ToLower(language), "+", "p", -1)
+	return strings.Trim(nonHookIDChars.ReplaceAllString(id, "-"), "-")
+}
+
+// hookTools names the programs run by formatter, for hook descriptions.
+func hookTools(formatter *formatter) string {
+	if formatter.NativeFunc != nil {
+		return "metafmt's built-in formatter"
+	}
+
+	var tools []string
+	for _, command := range formatter.Commands {
+		tools = append(tools, command[0])
+	}
+
+	return strings.Join(tools, " and ")
+}
+
+// hookFilesPattern returns the regular expression matching the names of files with one of exts.
+func hookFilesPattern(exts []string) string {
+	quoted := make([]string, len(exts))
+	for i, ext := range exts {
+		quoted[i] = regexp.QuoteMeta(ext)
+	}
+
+	return "(" + strings.Join(quoted, "|") + ")$"
+}
+
+// preCommitScript formats the staged files and stops the commit when that changed any of them,
+// so that the formatted files can be reviewed and staged again.
+const preCommitScript = `metafmt_manifest=$(mktemp) || exit 1
+metafmt -write -git-staged -write-manifest "$metafmt_manifest"
+metafmt_status=$?
+if [ $metafmt_status -eq 0 ] && [ -s "$metafmt_manifest" ]; then
+	echo "metafmt: formatted staged files, review and stage them again:" >&2
+	cat "$metafmt_manifest" >&2
+	metafmt_status=1
+fi
+rm -f "$metafmt_manifest"
+[ $metafmt_status -eq 0 ] || exit $metafmt_status
+`
+
+// preCommitHook is the part of a Git pre-commit hook added by installHook.
+const preCommitHook = "# Added by metafmt install-hook\n" + preCommitScript
+
+// generators are the subcommands writing configuration for hook managers to standard output.
+var generators = map[string]func(io.Writer) error{
+	"generate-hooks":    generatePreCommitHooks,
+	"generate-husky":    generateHusky,
+	"generate-lefthook": generateLefthook,
+}
+
+// generateLefthook writes a lefthook.yml running metafmt on the staged files before commits.
+// lefthook stages the files again once formatted.
+func generateLefthook(w io.Writer) error {
+	_, err := io.WriteString(w, `pre-commit:
+  commands:
+    metafmt:
+      run: metafmt -write {staged_files}
+      stage_fixed: true
+`)
+	return err
+}
+
+// generateHusky writes a .husky/pre-commit script running metafmt on the staged files.
+func generateHusky(w io.Writer) error {
+	_, err := io.WriteString(w, "#!/bin/sh\n\n"+preCommitScript)
+	return err
+}
+
+// installHook writes a Git pre-commit hook running metafmt on the staged files. An existing hook
+// is extended with it, unless -force is given to overwrite it.
+func installHook(args []string) error {
+	flags := flag.NewFlagSet("install-hook", flag.ExitOnError)
+	force := flags.Bool("force", false, "Overwrite the existing pre-commit hook, if any")
+	flags.Parse(args)
+
+	out, err := exec.Command("git", "rev-parse", "--git-path", "hooks").Output()
+	if err != nil {
+		return fmt.Errorf("not in a Git repository: %v", err)
+	}
+
+	hooksDir := strings.TrimSpace(string(out))
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(hooksDir, "pre-commit")
+
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var hook []byte
+	switch {
+	case err != nil || *force:
+		hook = []byte("#!/bin/sh\n\n" + preCommitHook)
+	case bytes.Contains(existing, []byte(preCommitHook)):
+		log.Printf("%s: metafmt is already installed", path)
+		return nil
+	default:
+		hook = append(existing, "\n"+preCommitHook...)
+	}
+
+	if err := ioutil.WriteFile(path, hook, 0755); err != nil {
+		return err
+	}
+
+	return os.Chmod(path, 0755)
+}
+
+// gitStagedFiles returns the paths of the files added, copied, modified or renamed in the Git
+// index, relative to the current directory when possible.
+func gitStagedFiles() ([]string, error) {
+	return gitChangedFiles("--cached")
+}
+
+// gitModifiedFiles returns the paths of the files added, copied, modified or renamed since the
+// last commit, whether staged or not, relative to the current directory when possible.
+func gitModifiedFiles() ([]string, error) {
+	return gitChangedFiles("HEAD")
+}
+
+// gitChangedFiles returns the paths of the files listed by git diff with args, leaving out
+// deleted ones.
+func gitChangedFiles(args ...string) ([]string, error) {
+	top, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return nil, fmt.Errorf("not in a Git repository: %v", err)
+	}
+
+	diffArgs := append([]string{"diff", "--name-only", "--diff-filter=ACMR", "-z"}, args...)
+
+	out, err := exec.Command("git", diffArgs...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff: %v", err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		path := filepath.Join(strings.TrimSpace(string(top)), filepath.FromSlash(name))
+		if rel, err := filepath.Rel(cwd, path); err == nil {
+			path = rel
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
@@ -37,7 +37,9 @@
 (define-globalized-minor-mode global-metafmt-mode metafmt-mode (lambda () (metafmt-mode t)))
 
 (defun metafmt-before-save ()
-  (let ((command `("metafmt" "-emacs" ,(symbol-name major-mode) "-"))
+  (let ((command `("metafmt" "-emacs" ,(symbol-name major-mode)
+                   ,@(when buffer-file-name (list "-stdin-filepath" buffer-file-name))
+                   "-"))
         (old-point (point))
         (old-window-start (window-start))
         (tmp-buffer (get-buffer-create " *metafmt*")))
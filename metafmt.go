@@ -23,13 +23,25 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/ungerik/go-dry"
 )
@@ -38,55 +50,407 @@ import (
 // Formatters
 //
 
+// filenamePlaceholder is replaced by the path of the file being formatted in command arguments,
+// which are templates rendered with commandData.
+const filenamePlaceholder = "{{.Filename}}"
+
+// legacyFilenamePlaceholder is what filenamePlaceholder used to be, still accepted in
+// configuration files and plugins.
+const legacyFilenamePlaceholder = "{filename}"
+
 type formatter struct {
-	Commands        [][]string
-	EmacsMajorModes []string
-	Extensions      []string
+	AdditionalArgs   []string // Appended to the first command, for instance to pass goimports -local
+	Commands         [][]string
+	EmacsMajorModes  []string
+	Extensions       []string
+	Experimental     bool                // Only used with -experimental, for tools that are not stable yet
+	Extras           map[string][]string // Optional steps, run when enabled by name in .metafmt.toml
+	Fallbacks        [][]string          // Commands tried in order when a program run by Commands is missing
+	FileMode         bool                // Commands format a temporary file in place instead of standard input
+	Filenames        []string            // Globs matched against the base name of files, or their slash-separated path when they contain a slash
+	Language         string              // Name of the language, for messages and for selecting the formatter in .metafmt.toml
+	LineWidthFlag    string              // Option of the first command setting the line length given with -line-length
+	LocalFlag        string              // Option of the first command for grouping the imports of the module given with -local
+	NativeFunc       nativeFunc          // Formats in-process, in place of Commands
+	Shell            bool                // Commands are run by sh -c, their arguments joined with spaces
+	SkipPatterns     []string            // Globs matched against the slash-separated path of skipped files
+	StripFrontMatter bool                // Keep front matter away from the commands, which would mangle it
+	Validators       [][]string
+}
+
+// jsdocCommand fixes the alignment of JSDoc comments. It needs eslint-plugin-jsdoc.
+var jsdocCommand = []string{
+	"eslint_d", "--fix-to-stdout", "--plugin", "jsdoc", "--rule", "jsdoc/check-alignment: error",
+	"--stdin", "--stdin-filename", filenamePlaceholder,
+}
+
+// emacsIndent returns a command that reindents standard input with Emacs in the given major mode.
+func emacsIndent(majorMode string) []string {
+	program := `(progn
+		(insert-file-contents "/dev/stdin")
+		(%s)
+		(setq indent-tabs-mode nil)
+		(indent-region (point-min) (point-max))
+		(princ (buffer-string)))`
+
+	return []string{"emacs", "-Q", "--batch", "--eval", fmt.Sprintf(program, majorMode)}
 }
 
 var formatters = []*formatter{
-	// C/C++
 	{
+		Language: "Ada",
+		Commands: [][]string{
+			[]string{"gnatpp", "--pipe", "-"},
+		},
+		EmacsMajorModes: []string{"ada-mode"},
+		Extensions:      []string{".adb", ".ads"},
+	},
+	{
+		Language: "Agda",
+		// No formatter yet: registered so that Agda buffers get a meaningful error
+		EmacsMajorModes: []string{"agda-mode", "agda2-mode"},
+		Extensions:      []string{".agda"},
+	},
+	{
+		Language: "Apache",
+		// No formatter yet: registered so that Apache buffers get a meaningful error
+		EmacsMajorModes: []string{"apache-mode"},
+		Filenames:       []string{".htaccess", "apache2.conf", "httpd.conf", "**/apache2/**/*.conf", "**/httpd/**/*.conf"},
+	},
+	{
+		Language: "ATS",
+		Commands: [][]string{
+			[]string{"atsformat"},
+		},
+		EmacsMajorModes: []string{"ats-mode"},
+		Extensions:      []string{".dats", ".hats", ".sats"},
+	},
+	{
+		Language: "BibTeX",
+		Commands: [][]string{
+			[]string{"bibtex-tidy"},
+		},
+		EmacsMajorModes: []string{"bibtex-mode"},
+		Extensions:      []string{".bib"},
+	},
+	{
+		Language: "Bicep",
+		Commands: [][]string{
+			[]string{"bicep", "format", "--stdout", "-"},
+		},
+		EmacsMajorModes: []string{"bicep-mode"},
+		Extensions:      []string{".bicep"},
+	},
+	{
+		Language: "C/C++",
 		Commands: [][]string{
 			[]string{"clang-format", "-style=WebKit", "-"},
 		},
 		EmacsMajorModes: []string{"c-mode", "c++-mode"},
 		Extensions:      []string{".c", ".cpp", ".cxx", ".h", ".hpp", ".hxx"},
 	},
-	// CSS
 	{
+		Language: "Caddyfile",
+		Commands: [][]string{
+			[]string{"caddy", "fmt", "-"},
+		},
+		EmacsMajorModes: []string{"caddyfile-mode"},
+		Extensions:      []string{".caddyfile"},
+		Filenames:       []string{"Caddyfile", "Caddyfile.*"},
+	},
+	{
+		Language: "Carbon",
+		Commands: [][]string{
+			[]string{"carbon-toolchain", "format", "-"},
+		},
+		EmacsMajorModes: []string{"carbon-mode"},
+		Experimental:    true,
+		Extensions:      []string{".carbon"},
+	},
+	{
+		Language: "Clojure",
+		Commands: [][]string{
+			[]string{"cljfmt", "fix", "-"},
+		},
+		Fallbacks: [][]string{
+			[]string{"zprint"},
+		},
+		EmacsMajorModes: []string{"clojure-mode", "clojurescript-mode"},
+		Extensions:      []string{".clj", ".cljc", ".cljs", ".edn"},
+	},
+	{
+		Language: "Common Lisp",
+		Commands: [][]string{
+			emacsIndent("lisp-mode"),
+		},
+		EmacsMajorModes: []string{"common-lisp-mode", "lisp-mode"},
+		Extensions:      []string{".cl", ".lisp", ".lsp"},
+	},
+	{
+		Language: "Coq",
+		Commands: [][]string{
+			[]string{"coqfmt", "-"},
+		},
+		EmacsMajorModes: []string{"coq-mode"},
+		Experimental:    true,
+		// .v is V's by default, see the README for formatting .v files as Coq
+	},
+	{
+		Language: "Crystal",
 		Commands: [][]string{
-			[]string{"cssfmt"},
+			[]string{"crystal", "tool", "format", "-"},
+		},
+		EmacsMajorModes: []string{"crystal-mode"},
+		Extensions:      []string{".cr"},
+	},
+	{
+		Language: "CSS",
+		Commands: [][]string{
+			[]string{"prettier", "--parser", "css", "--stdin-filepath", filenamePlaceholder},
 		},
 		EmacsMajorModes: []string{"css-mode"},
 		Extensions:      []string{".css"},
+		LineWidthFlag:   "--print-width",
+	},
+	{
+		Language: "D",
+		Commands: [][]string{
+			[]string{"dfmt", "--stdin"},
+		},
+		EmacsMajorModes: []string{"d-mode"},
+		Extensions:      []string{".d", ".di"},
+	},
+	{
+		Language: "Django",
+		Commands: [][]string{
+			[]string{"djlint", "--profile", "django", "-", "--reformat"},
+		},
+		// .html is shared with plain HTML, see the README for formatting Django templates
+	},
+	{
+		Language:        "dotenv",
+		EmacsMajorModes: []string{"dotenv-mode"},
+		Extensions:      []string{".env"},
+		Filenames:       []string{".env", ".env.*"},
+		NativeFunc:      formatDotenv,
+	},
+	{
+		Language: "Elm",
+		Commands: [][]string{
+			[]string{"elm-format", "--stdin"},
+		},
+		EmacsMajorModes: []string{"elm-mode"},
+		Extensions:      []string{".elm"},
+	},
+	{
+		Language: "ERB",
+		Commands: [][]string{
+			[]string{"erb-format", "--print-width", "100", "-"},
+		},
+		Extensions:    []string{".erb"},
+		LineWidthFlag: "--print-width",
+	},
+	{
+		Language: "Fortran",
+		Commands: [][]string{
+			[]string{"fprettify", "-"},
+		},
+		EmacsMajorModes: []string{"f90-mode"},
+		Extensions:      []string{".f", ".f03", ".f08", ".f90", ".f95"},
+		LineWidthFlag:   "--line-length",
+	},
+	{
+		Language: "Gleam",
+		Commands: [][]string{
+			[]string{"gleam", "format", "--stdin"},
+		},
+		EmacsMajorModes: []string{"gleam-mode"},
+		Extensions:      []string{".gleam"},
+	},
+	{
+		Language: "GLSL",
+		Commands: [][]string{
+			[]string{"glsl-format"},
+		},
+		EmacsMajorModes: []string{"glsl-mode"},
+		Extensions:      []string{".comp", ".frag", ".geom", ".glsl", ".vert"},
 	},
-	// Go
 	{
+		Language: "Go",
 		Commands: [][]string{
 			[]string{"goimports"},
 		},
 		EmacsMajorModes: []string{"go-mode"},
 		Extensions:      []string{".go"},
+		LocalFlag:       "-local",
+	},
+	{
+		Language: "Haml",
+		Commands: [][]string{
+			[]string{"haml-lint", "--auto-correct-all", filenamePlaceholder},
+		},
+		EmacsMajorModes: []string{"haml-mode"},
+		Extensions:      []string{".haml"},
+		FileMode:        true,
+	},
+	{
+		Language: "Idris",
+		Commands: [][]string{
+			[]string{"idris2", "--format"},
+		},
+		EmacsMajorModes: []string{"idris-mode"},
+		Experimental:    true,
+		Extensions:      []string{".idr"},
+	},
+	{
+		Language: "Janet",
+		Commands: [][]string{
+			[]string{"janet", "-e", "(import spork/fmt) (prin (fmt/format (file/read stdin :all)))"},
+		},
+		EmacsMajorModes: []string{"janet-mode"},
+		Extensions:      []string{".janet"},
 	},
-	// JavaScript
 	{
+		Language: "JavaScript",
 		Commands: [][]string{
+			[]string{"prettier", "--parser", "babel", "--stdin-filepath", filenamePlaceholder},
+		},
+		Extras: map[string][]string{
+			"jsdoc": jsdocCommand,
+		},
+		Fallbacks: [][]string{
 			[]string{"semistandard-format", "-"},
 		},
 		EmacsMajorModes: []string{"js-mode", "js2-mode", "js3-mode"},
 		Extensions:      []string{".js", ".jsx"},
+		LineWidthFlag:   "--print-width",
 	},
-	// JSON
 	{
+		Language: "Jinja2",
+		Commands: [][]string{
+			[]string{"djlint", "-", "--reformat"},
+		},
+		EmacsMajorModes: []string{"jinja2-mode"},
+		Extensions:      []string{".j2", ".jinja", ".jinja2"},
+	},
+	{
+		Language: "JSON",
 		Commands: [][]string{
 			[]string{"jsonlint", "--sort-keys", "-"},
 		},
 		EmacsMajorModes: []string{"json-mode"},
-		Extensions:      []string{".json"},
+		Extensions:      []string{".avsc", ".json"},
+	},
+	{
+		Language: "LaTeX",
+		Commands: [][]string{
+			[]string{"latexindent", "-"},
+		},
+		EmacsMajorModes: []string{"latex-mode", "LaTeX-mode"},
+		Extensions:      []string{".tex"},
+	},
+	{
+		Language: "Lean",
+		Commands: [][]string{
+			[]string{"lake", "fmt", "-"},
+		},
+		EmacsMajorModes: []string{"lean4-mode"},
+		Extensions:      []string{".lean"},
+	},
+	{
+		Language: "Liquid",
+		Commands: [][]string{
+			[]string{"prettier", "--plugin", "@shopify/prettier-plugin-liquid", "--stdin-filepath", filenamePlaceholder},
+		},
+		EmacsMajorModes: []string{"liquid-mode"},
+		Extensions:      []string{".liquid"},
+		LineWidthFlag:   "--print-width",
+	},
+	{
+		Language: "Mako",
+		Commands: [][]string{
+			[]string{"htmlbeautifier"},
+		},
+		Extensions: []string{".mak", ".mako"},
+	},
+	{
+		Language: "Markdown",
+		Commands: [][]string{
+			[]string{"mdformat", "-"},
+		},
+		EmacsMajorModes:  []string{"gfm-mode", "markdown-mode"},
+		Extensions:       []string{".markdown", ".md"},
+		StripFrontMatter: true,
+	},
+	{
+		Language: "Metal",
+		Commands: [][]string{
+			[]string{"clang-format", "-style=Google", "-"},
+		},
+		EmacsMajorModes: []string{"metal-mode"},
+		Extensions:      []string{".metal"},
+	},
+	{
+		Language: "Nginx",
+		Commands: [][]string{
+			[]string{"nginxbeautifier", filenamePlaceholder},
+		},
+		EmacsMajorModes: []string{"nginx-mode"},
+		FileMode:        true,
+		Filenames:       []string{"nginx.conf", "**/nginx/**/*.conf"},
 	},
-	// Python
 	{
+		Language: "Nim",
+		Commands: [][]string{
+			[]string{"nimpretty", "--indent:2", filenamePlaceholder},
+		},
+		EmacsMajorModes: []string{"nim-mode"},
+		Extensions:      []string{".nim"},
+		FileMode:        true,
+	},
+	{
+		Language: "Odin",
+		Commands: [][]string{
+			[]string{"odinfmt", "-"},
+		},
+		EmacsMajorModes: []string{"odin-mode"},
+		Extensions:      []string{".odin"},
+	},
+	{
+		Language: "OpenAPI",
+		Commands: [][]string{
+			[]string{"openapi-format", filenamePlaceholder, "--output", filenamePlaceholder},
+		},
+		FileMode: true,
+		// .json and .yaml are shared with other files, see the README for formatting specifications
+	},
+	{
+		Language: "Pkl",
+		Commands: [][]string{
+			[]string{"pkl", "format", "--"},
+		},
+		EmacsMajorModes: []string{"pkl-mode"},
+		Extensions:      []string{".pkl"},
+	},
+	{
+		Language: "Pug",
+		Commands: [][]string{
+			[]string{"prettier", "--plugin", "@prettier/plugin-pug", "--parser", "pug", "--stdin-filepath", filenamePlaceholder},
+		},
+		EmacsMajorModes: []string{"pug-mode"},
+		Extensions:      []string{".jade", ".pug"},
+		LineWidthFlag:   "--print-width",
+	},
+	{
+		Language: "PureScript",
+		Commands: [][]string{
+			[]string{"purs-tidy", "format"},
+		},
+		EmacsMajorModes: []string{"purescript-mode"},
+		Extensions:      []string{".purs"},
+	},
+	{
+		Language: "Python",
 		Commands: [][]string{
 			[]string{"autopep8", "--max-line-length=98", "-"},
 			[]string{"isort", "--line-width", "98", "--multi_line", "3", "-"},
@@ -94,197 +458,1716 @@ var formatters = []*formatter{
 		EmacsMajorModes: []string{"python-mode"},
 		Extensions:      []string{".py"},
 	},
-	// SASS
 	{
+		Language: "Racket",
+		Commands: [][]string{
+			[]string{"raco", "fmt"},
+		},
+		EmacsMajorModes: []string{"racket-hash-lang-mode", "racket-mode"},
+		Extensions:      []string{".rkt", ".rktl"},
+	},
+	{
+		Language: "Reason",
+		Commands: [][]string{
+			[]string{"refmt", "--print", "re"},
+		},
+		EmacsMajorModes: []string{"reason-mode"},
+		Extensions:      []string{".re"},
+	},
+	{
+		Language: "Reason interfaces",
+		Commands: [][]string{
+			[]string{"refmt", "--print", "re", "--interface", "true"},
+		},
+		Extensions: []string{".rei"},
+	},
+	{
+		Language: "ReScript",
+		Commands: [][]string{
+			[]string{"rescript", "format", "-stdin", ".res"},
+		},
+		EmacsMajorModes: []string{"rescript-mode"},
+		Extensions:      []string{".res"},
+	},
+	{
+		Language: "ReScript interfaces",
+		Commands: [][]string{
+			[]string{"rescript", "format", "-stdin", ".resi"},
+		},
+		Extensions: []string{".resi"},
+	},
+	{
+		Language: "SASS",
 		Commands: [][]string{
 			[]string{"sass-convert", "--no-cache", "--from", "sass", "--to", "sass", "--indent", "4", "--stdin"},
 		},
 		EmacsMajorModes: []string{"sass-mode"},
 		Extensions:      []string{".sass"},
 	},
-	// SCSS
 	{
+		Language: "Scheme",
+		Commands: [][]string{
+			[]string{"chicken-format", "-"},
+		},
+		Fallbacks: [][]string{
+			emacsIndent("scheme-mode"),
+		},
+		EmacsMajorModes: []string{"scheme-mode"},
+		Extensions:      []string{".scm", ".ss"},
+	},
+	{
+		Language: "SCSS",
 		Commands: [][]string{
-			[]string{"sass-convert", "--no-cache", "--from", "scss", "--to", "scss", "--indent", "4", "--stdin"},
+			[]string{"prettier", "--parser", "scss", "--stdin-filepath", filenamePlaceholder},
 		},
 		EmacsMajorModes: []string{"scss-mode"},
 		Extensions:      []string{".scss"},
+		LineWidthFlag:   "--print-width",
+	},
+	{
+		Language: "Slim",
+		// slim-lint only reports offenses, there is no formatter to run yet
+		EmacsMajorModes: []string{"slim-mode"},
+		Extensions:      []string{".slim"},
+	},
+	{
+		Language: "Starlark",
+		Commands: [][]string{
+			[]string{"buildifier", "-type=bzl", "-"},
+		},
+		EmacsMajorModes: []string{"bazel-starlark-mode", "starlark-mode"},
+		Extensions:      []string{".bzl", ".star"},
+	},
+	{
+		Language:        "Tcl",
+		EmacsMajorModes: []string{"tcl-mode"},
+		Extensions:      []string{".tcl"},
+		NativeFunc:      formatTcl,
+	},
+	{
+		Language: "Twig",
+		Commands: [][]string{
+			[]string{"prettier", "--plugin", "prettier-plugin-twig-melody", "--parser", "twig", "--stdin-filepath", filenamePlaceholder},
+		},
+		EmacsMajorModes: []string{"twig-mode"},
+		Extensions:      []string{".twig"},
+		LineWidthFlag:   "--print-width",
+	},
+	{
+		Language: "TypeScript",
+		Commands: [][]string{
+			[]string{"prettier", "--parser", "typescript", "--stdin-filepath", filenamePlaceholder},
+		},
+		EmacsMajorModes: []string{"tsx-ts-mode", "typescript-mode", "typescript-ts-mode"},
+		Extensions:      []string{".ts", ".tsx"},
+		LineWidthFlag:   "--print-width",
+		Extras: map[string][]string{
+			"jsdoc": jsdocCommand,
+		},
+	},
+	{
+		Language: "V",
+		Commands: [][]string{
+			[]string{"v", "fmt", "-"},
+		},
+		EmacsMajorModes: []string{"v-mode"},
+		Extensions:      []string{".v"},
+	},
+	{
+		Language: "Verilog",
+		Commands: [][]string{
+			[]string{"verible-verilog-format", "-"},
+		},
+		EmacsMajorModes: []string{"verilog-mode", "verilog-ts-mode"},
+		// .v is V's by default, see the README for formatting .v files as Verilog
+		Extensions: []string{".sv", ".svh"},
+	},
+	{
+		Language: "VHDL",
+		Commands: [][]string{
+			[]string{"vsg", "--fix", "--stdin"},
+		},
+		Fallbacks: [][]string{
+			emacsIndent("vhdl-mode"),
+		},
+		EmacsMajorModes: []string{"vhdl-mode"},
+		Extensions:      []string{".vhd", ".vhdl"},
+	},
+	{
+		Language: "WebAssembly Text",
+		Commands: [][]string{
+			[]string{"wasm-tools", "print", "-"},
+		},
+		EmacsMajorModes: []string{"wat-mode"},
+		Extensions:      []string{".wat"},
+	},
+	{
+		Language: "WGSL",
+		Commands: [][]string{
+			[]string{"wgsl-analyzer", "format"},
+		},
+		EmacsMajorModes: []string{"wgsl-mode"},
+		Extensions:      []string{".wgsl"},
+	},
+	{
+		Language: "YAML",
+		Commands: [][]string{
+			[]string{"yamlfmt", "-"},
+		},
+		EmacsMajorModes: []string{"yaml-mode"},
+		Extensions:      []string{".yaml", ".yml"},
+		// Helm chart templates are Go templates, not YAML
+		SkipPatterns: []string{"**/templates/**"},
 	},
 }
 
-//
-// Lookup maps
-//
+//
+// Lookup maps
+//
+
+type lookupMap map[string]*formatter
+
+var emacsToFormatter = make(lookupMap)
+var extToFormatter = make(lookupMap)
+
+func init() {
+	for _, formatter := range formatters {
+		register(formatter)
+	}
+}
+
+// register adds formatter to the lookup maps, replacing any formatter previously registered for
+// the same extensions or major modes.
+func register(formatter *formatter) {
+	for _, ext := range formatter.Extensions {
+		extToFormatter[ext] = formatter
+	}
+
+	for _, majorMode := range formatter.EmacsMajorModes {
+		emacsToFormatter[majorMode] = formatter
+	}
+}
+
+func formatterForEmacs() *formatter {
+	if *emacs == "" {
+		return nil
+	}
+
+	formatter, ok := emacsToFormatter[*emacs]
+	if !ok || (formatter.Experimental && !*experimental) {
+		return nil
+	}
+
+	return formatter
+}
+
+func formatterForLanguage(language string) *formatter {
+	for _, formatter := range formatters {
+		if strings.EqualFold(formatter.Language, language) {
+			return formatter
+		}
+	}
+
+	return nil
+}
+
+func formatterForPath(path string) *formatter {
+	formatter := formatterForFilename(path)
+	if formatter == nil {
+		formatter = formatterForExt(path)
+	}
+
+	return applyOverride(path, formatter)
+}
+
+// applyOverride returns formatter as changed by the configuration file override for path, if any.
+func applyOverride(path string, formatter *formatter) *formatter {
+	if override := overrideForPath(path); override != nil {
+		formatter = override.apply(formatter)
+	}
+
+	return formatter
+}
+
+// formatterForFilename returns the formatter with Filenames matching path, which takes precedence
+// over extensions. Patterns with wildcards in the file name, like ".env.*", don't claim files with
+// an extension that has a formatter of its own, like ".env.json". Formatters registered last, like
+// plugins, are tried first.
+func formatterForFilename(path string) *formatter {
+	base := filepath.Base(path)
+	slashPath := filepath.ToSlash(path)
+	hasExtFormatter := formatterForExt(path) != nil
+
+	for i := len(formatters) - 1; i >= 0; i-- {
+		formatter := formatters[i]
+		if formatter.Experimental && !*experimental {
+			continue
+		}
+
+		for _, pattern := range formatter.Filenames {
+			name := base
+			if strings.Contains(pattern, "/") {
+				name = slashPath
+			}
+
+			if hasExtFormatter && strings.ContainsAny(pattern[strings.LastIndex(pattern, "/")+1:], "*?[") {
+				continue
+			}
+
+			if matchGlob(pattern, name) {
+				if formatter.skips(path) {
+					return nil
+				}
+
+				return formatter
+			}
+		}
+	}
+
+	return nil
+}
+
+// formatterForExt returns the formatter registered for the longest of the extensions of path,
+// so that for instance ".module.css" files can be formatted differently than ".css" ones.
+func formatterForExt(path string) *formatter {
+	for _, ext := range extensions(path) {
+		formatter, ok := extToFormatter[ext]
+		if !ok || (formatter.Experimental && !*experimental) {
+			continue
+		}
+
+		if formatter.skips(path) {
+			return nil
+		}
+
+		return formatter
+	}
+
+	return nil
+}
+
+// skips reports whether path matches one of the SkipPatterns of the formatter.
+func (f *formatter) skips(path string) bool {
+	for _, pattern := range f.SkipPatterns {
+		if matchGlob(pattern, filepath.ToSlash(path)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extensions returns the extensions of path, longest first: ".module.css" and ".css" for
+// "button.module.css". The leading dot of hidden files like ".eslintrc.json" doesn't start one.
+func extensions(path string) []string {
+	base := filepath.Base(path)
+
+	var exts []string
+	for i := 1; i < len(base); i++ {
+		if base[i] == '.' {
+			exts = append(exts, base[i:])
+		}
+	}
+
+	return exts
+}
+
+//
+// Flags
+//
+
+// stringList is a flag that can be repeated, accumulating its values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// byteSize is a flag holding a number of bytes, optionally followed by a k, m or g multiplier.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("invalid size %q", value)
+	}
+
+	digits, multiplier := value, int64(1)
+
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+
+	if multiplier != 1 {
+		digits = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+var ignoreDirs stringList
+var onlyExts stringList
+var maxFileSize byteSize
+
+func init() {
+	flag.Var(&ignoreDirs, "ignore-dir", "Skip directories with this name, or matching this pattern, in addition to the default ones (repeatable)")
+	flag.Var(&onlyExts, "only", "In directories, only format files with this extension (repeatable)")
+	flag.Var(&maxFileSize, "max-file-size", "Skip files larger than this many bytes, with an optional k, m or g suffix (0 for no limit)")
+	flag.IntVar(lineLength, "print-width", 0, "Same as -line-length")
+	flag.StringVar(stdinFilepath, "stdin-filename", "", "Same as -stdin-filepath")
+}
+
+var emacs = flag.String("emacs", "", "Emacs major mode")
+var write = flag.Bool("write", false, "Write the file in place")
+var allowEmptyOutput = flag.Bool("allow-empty-output", false, "With -write, overwrite files even when the formatter outputs nothing")
+var appendNewline = flag.Bool("append-newline", false, "Make sure that formatted files end with a newline")
+var lineLength = flag.Int("line-length", 0, "Maximum line length, for the formatters that support setting it (0 for their default)")
+
+var experimental = flag.Bool("experimental", false, "Enable formatters for languages whose tools are not stable yet")
+var jobs = flag.Int("j", 1, "Number of files to format in parallel")
+var progress = flag.Bool("progress", false, "Report progress on standard error")
+var verbose = flag.Bool("v", false, "Report skipped binary files, how long formatting took and the slowest files on standard error")
+var checkIdempotent = flag.Bool("check-idempotent", false, "Check that formatting files twice gives the same result as formatting them once")
+var commitMsg = flag.String("commit-msg", "", "Format the Git commit message in the given file in place")
+var writeManifest = flag.String("write-manifest", "", "With -write, list the files that were changed in the given file")
+var stdinFilepath = flag.String("stdin-filepath", "", "Path of the file being formatted on standard input, for choosing its formatter and for the formatter to use")
+var stdinExt = flag.String("stdin-ext", "", "Extension of the file being formatted on standard input, when -stdin-filepath isn't given")
+var batch = flag.Bool("batch", false, "Format NUL-terminated file name and content records read from standard input")
+var filterMode = flag.Bool("filter-mode", false, "When formatting standard input, echo it back unchanged on failure")
+var stdinFallback = flag.String("stdin-fallback", "error", "When no formatter handles standard input, copy it to standard output (passthrough), fail (error) or output nothing (silent)")
+var local = flag.String("local", "", "Module path whose imports goimports puts in a group of their own")
+var autoLocal = flag.Bool("auto-local", false, "Without -local, use the path of the Go module containing each file")
+var skipGenerated = flag.Bool("skip-generated", false, "Skip files that say they were generated near their beginning")
+var warnNoFormatter = flag.Bool("warn-no-formatter", false, "Warn about files given as arguments that no formatter handles")
+var check = flag.Bool("check", false, "List the files that aren't formatted instead of formatting them, and exit with a non-zero status if there are any")
+var showDiff = flag.Bool("diff", false, "Show how files would change instead of formatting them")
+var diffTool = flag.String("diff-tool", "", "Program, with its arguments, whose standard input differences are written to instead of standard output")
+var jsonOutput = flag.Bool("json", false, "Report the files found by -check or -diff as JSON")
+var ci = flag.Bool("ci", false, "Shorthand for -check -diff -json, for continuous integration")
+var reportFile = flag.String("report-file", "", "Also add the files found by -check or -diff to the JSON report in the given file")
+var reportOverwrite = flag.Bool("report-overwrite", false, "Replace the -report-file instead of adding to it")
+var gitStaged = flag.Bool("git-staged", false, "Format the files staged in Git, in addition to the arguments")
+var gitModified = flag.Bool("git-modified", false, "Format the files changed in Git since the last commit, staged or not, in addition to the arguments")
+var fileListPath = flag.String("file-list", "", "Also format the files listed in the given file, one per line, or on standard input with -")
+
+//
+// Entry point
+//
+
+type formatOp func(string, *formatter) error
+
+func main() {
+	// Flags
+	flag.Parse()
+
+	switch *stdinFallback {
+	case "error", "passthrough", "silent":
+	default:
+		log.Fatalf("-stdin-fallback must be passthrough, error or silent, not %q", *stdinFallback)
+	}
+
+	if *stdinFilepath == "" && *stdinExt != "" {
+		*stdinFilepath = "stdin." + strings.TrimPrefix(*stdinExt, ".")
+	}
+
+	// Configuration
+	if err := loadPlugins(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := loadConfig(); err != nil {
+		log.Fatalln(err)
+	}
+
+	ignoreDirsFromEnv()
+	addIgnoreDirs(ignoreDirs)
+
+	// Format a batch of files from standard input, then stop
+	if *batch {
+		formatBatch()
+		return
+	}
+
+	// Format a commit message, then stop
+	if *commitMsg != "" {
+		if err := formatWrite(*commitMsg, commitMsgFormatter); err != nil {
+			log.Fatalln(err)
+		}
+
+		return
+	}
+
+	args := flag.Args()
+	readFileList := fileListRequested(args)
+	if readFileList {
+		args = nil
+	}
+
+	if len(args) < 1 && !*gitStaged && !*gitModified && !readFileList && *fileListPath == "" {
+		return
+	}
+
+	// Run a subcommand, then stop
+	if len(args) > 0 {
+		if generate, ok := generators[args[0]]; ok {
+			if err := generate(os.Stdout); err != nil {
+				log.Fatalln(err)
+			}
+
+			return
+		}
+
+		switch args[0] {
+		case "install-hook":
+			if err := installHook(args[1:]); err != nil {
+				log.Fatalln(err)
+			}
+
+			return
+		}
+	}
+
+	// Format standard input, then stop
+	if len(args) == 1 && args[0] == "-" {
+		formatStdin()
+		return
+	}
+
+	// Select mode of operation (format to file or standard output)
+	var op formatOp
+	if *ci {
+		*check, *showDiff, *jsonOutput = true, true, true
+	}
+
+	checking := checkMode()
+
+	if *checkIdempotent {
+		op = formatCheckIdempotent
+	} else if checking {
+		op = formatCheck
+	} else if *write {
+		op = formatWrite
+
+		if *writeManifest != "" {
+			file, err := os.Create(*writeManifest)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			defer file.Close()
+
+			manifest = file
+		}
+	} else {
+		op = formatStdout
+
+		// Files formatted in parallel would be written to standard output in no particular order
+		if *jobs > 1 {
+			log.Fatalln("-j needs -write, -check or -diff")
+		}
+	}
+
+	// Format files
+	if readFileList || *fileListPath != "" {
+		list, err := listedFiles()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		args = append(args, list...)
+	}
+
+	var paths []string
+	for _, path := range args {
+		if dry.FileIsDir(path) {
+			paths = append(paths, walkDir(path)...)
+		} else {
+			if *warnNoFormatter && formatterForPath(path) == nil {
+				log.Printf("%s: no formatter for this file", path)
+			}
+
+			paths = append(paths, path)
+		}
+	}
+
+	if *gitModified {
+		paths = append(paths, gitPaths(gitModifiedFiles)...)
+	} else if *gitStaged {
+		paths = append(paths, gitPaths(gitStagedFiles)...)
+	}
+
+	start := time.Now()
+	formatFiles(paths, op)
+
+	if *verbose {
+		reportTimings(os.Stderr, time.Since(start))
+	}
+
+	if *jsonOutput {
+		if err := writeCheckReport(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *reportFile != "" && checking {
+		if err := writeReportFile(*reportFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *ci && len(unformatted) > 0 {
+		log.Printf("%d files need formatting: run `metafmt -write` on them, see %s", len(unformatted), ciDocsURL)
+	}
+
+	if atomic.LoadInt32(&failed) != 0 {
+		os.Exit(1)
+	}
+}
+
+// gitPaths returns the files listed by gitFiles that have one of the extensions given with -only.
+func gitPaths(gitFiles func() ([]string, error)) []string {
+	files, err := gitFiles()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var paths []string
+	for _, path := range files {
+		if hasOnlyExt(path) {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// fileListRequested reports whether the files to format are to be read from standard input, as
+// asked with a "--" argument. flag.Parse takes a first "--" as the end of the flags, leaving no
+// arguments, so that one is looked for in os.Args.
+func fileListRequested(args []string) bool {
+	if len(args) == 1 && args[0] == "--" {
+		return true
+	}
+
+	return len(args) == 0 && len(os.Args) > 1 && os.Args[len(os.Args)-1] == "--"
+}
+
+// listedFiles returns the names of the files listed in the file given with -file-list or, with
+// "--" or "-file-list -", on standard input.
+func listedFiles() ([]string, error) {
+	if *fileListPath == "" || *fileListPath == "-" {
+		return fileList(os.Stdin)
+	}
+
+	file, err := os.Open(*fileListPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return fileList(file)
+}
+
+// fileList reads file names from r, one per line. Blank lines are ignored.
+func fileList(r io.Reader) ([]string, error) {
+	var names []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if name := strings.TrimSuffix(scanner.Text(), "\r"); strings.TrimSpace(name) != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, scanner.Err()
+}
+
+//
+// High level operations
+//
+
+var IgnoreDirs = []string{".git", ".hg", ".svn", "node_modules"}
+
+// IgnoreDirPatterns are globs matched against the slash-separated path of directories relative to
+// the directory being walked ("**" matches any number of directories).
+var IgnoreDirPatterns = []string{"**/vendor"}
+
+// ignoreDirsFromEnv replaces IgnoreDirs and IgnoreDirPatterns with the list of directory names
+// and patterns in $METAFMT_IGNORE_DIRS, separated like $PATH. An empty value keeps the defaults,
+// "-" ignores no directories.
+func ignoreDirsFromEnv() {
+	switch env := os.Getenv("METAFMT_IGNORE_DIRS"); env {
+	case "":
+	case "-":
+		IgnoreDirs, IgnoreDirPatterns = nil, nil
+	default:
+		IgnoreDirs, IgnoreDirPatterns = nil, nil
+		addIgnoreDirs(filepath.SplitList(env))
+	}
+}
+
+// addIgnoreDirs adds names to IgnoreDirs, or to IgnoreDirPatterns for those that contain a slash
+// or a wildcard.
+func addIgnoreDirs(names []string) {
+	for _, name := range names {
+		if strings.ContainsAny(name, "/*?[") {
+			IgnoreDirPatterns = append(IgnoreDirPatterns, name)
+		} else {
+			IgnoreDirs = append(IgnoreDirs, name)
+		}
+	}
+}
+
+// isIgnoredDir reports whether the directory at path, found while walking root, is to be skipped.
+func isIgnoredDir(root, path string) bool {
+	if dry.StringListContains(IgnoreDirs, filepath.Base(path)) {
+		return true
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range IgnoreDirPatterns {
+		if matchGlob(pattern, filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// walkDir returns the files to format in root, recursively.
+func walkDir(root string) []string {
+	var paths []string
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() && isIgnoredDir(root, path) {
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() && hasOnlyExt(path) {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+
+	return paths
+}
+
+// formatFiles formats paths with as many files in flight as requested with -j.
+func formatFiles(paths []string, op formatOp) {
+	var formatted, inFlight int32
+	var wg sync.WaitGroup
+
+	work := make(chan string)
+
+	workers := *jobs
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for path := range work {
+				atomic.AddInt32(&inFlight, 1)
+				formatFile(path, op)
+				running := atomic.AddInt32(&inFlight, -1)
+
+				if *progress {
+					fmt.Fprintf(os.Stderr, "\r[%d/%d] formatted, %d in flight", atomic.AddInt32(&formatted, 1), len(paths), running)
+				}
+			}
+		}()
+	}
+
+	for _, path := range paths {
+		work <- path
+	}
+
+	close(work)
+	wg.Wait()
+
+	if *progress && len(paths) > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// hasOnlyExt reports whether path has one of the extensions given with -only, if any.
+func hasOnlyExt(path string) bool {
+	if len(onlyExts) == 0 {
+		return true
+	}
+
+	for _, ext := range extensions(path) {
+		for _, only := range onlyExts {
+			if ext == only || ext == "."+only {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func formatFile(path string, op formatOp) {
+	formatter := formatterForPath(path)
+	if formatter == nil || !formatter.canFormat() {
+		return
+	}
+
+	if !formatter.available() {
+		if checkMode() {
+			warnNotInstalled(formatter)
+		}
+
+		return
+	}
+
+	if maxFileSize > 0 {
+		if info, err := os.Stat(path); err == nil && info.Size() > int64(maxFileSize) {
+			log.Printf("%s: skipped, larger than -max-file-size (%d bytes)", path, info.Size())
+			return
+		}
+	}
+
+	if isBinary(path) {
+		if *verbose {
+			log.Printf("%s: skipped, not a text file", path)
+		}
+
+		return
+	}
+
+	if *skipGenerated && isGenerated(path) {
+		return
+	}
+
+	start := time.Now()
+	err := op(path, formatter)
+
+	if *verbose {
+		recordTiming(path, time.Since(start))
+	}
+
+	// Other files may be being written, so metafmt only exits once they are done
+	if err != nil {
+		log.Println(err)
+		atomic.StoreInt32(&failed, 1)
+	}
+}
+
+// checkMode reports whether files are checked, with -check, -diff or -json, rather than formatted.
+func checkMode() bool {
+	return *check || *showDiff || *jsonOutput
+}
+
+var warnedNotInstalled = make(map[string]bool)
+var warnedNotInstalledMutex sync.Mutex
+
+// warnNotInstalled warns, once per language, that the files it formats aren't checked because
+// its program isn't installed. With -ci, this makes metafmt exit with a non-zero status.
+func warnNotInstalled(formatter *formatter) {
+	warnedNotInstalledMutex.Lock()
+	defer warnedNotInstalledMutex.Unlock()
+
+	if !warnedNotInstalled[formatter.Language] {
+		log.Printf("%s isn't installed, %s files aren't checked", formatter.program(), formatter.Language)
+		warnedNotInstalled[formatter.Language] = true
+	}
+
+	if *ci {
+		atomic.StoreInt32(&failed, 1)
+	}
+}
+
+// slowestFiles is how many of the files that took the longest to format -v reports.
+const slowestFiles = 5
+
+type fileTiming struct {
+	path     string
+	duration time.Duration
+}
+
+var timings []fileTiming
+var timingsMutex sync.Mutex
+
+func recordTiming(path string, duration time.Duration) {
+	timingsMutex.Lock()
+	defer timingsMutex.Unlock()
+
+	timings = append(timings, fileTiming{path, duration})
+}
+
+// reportTimings writes how long formatting took in total, followed by the slowest files.
+func reportTimings(w io.Writer, total time.Duration) {
+	fmt.Fprintf(w, "Total time: %.1fs\n", total.Seconds())
+
+	timingsMutex.Lock()
+	defer timingsMutex.Unlock()
+
+	sort.Slice(timings, func(i, j int) bool { return timings[i].duration > timings[j].duration })
+
+	for i, timing := range timings {
+		if i == slowestFiles {
+			break
+		}
+
+		fmt.Fprintf(w, "  %.2fs %s\n", timing.duration.Seconds(), timing.path)
+	}
+}
+
+// generatedHeaderSize is how much of a file -skip-generated looks at for a generated code marker.
+const generatedHeaderSize = 256
+
+// isGenerated reports whether the beginning of the file at path says that it was generated, as in
+// Go's "// Code generated by stringer; DO NOT EDIT." comments. Unreadable files aren't.
+func isGenerated(path string) bool {
+	header := readHeader(path, generatedHeaderSize)
+	return bytes.Contains(header, []byte("DO NOT EDIT")) ||
+		bytes.Contains(bytes.ToLower(header), []byte("generated by"))
+}
+
+// binaryHeaderSize is how much of a file is looked at for NUL bytes, like http.DetectContentType.
+const binaryHeaderSize = 512
+
+// isBinary reports whether the file at path looks like it doesn't contain text.
+func isBinary(path string) bool {
+	return bytes.IndexByte(readHeader(path, binaryHeaderSize), 0) >= 0
+}
+
+// readHeader returns up to the first size bytes of the file at path, or nil if it can't be read.
+func readHeader(path string, size int) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	header := make([]byte, size)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil
+	}
+
+	return header[:n]
+}
+
+func formatStdin() {
+	if formatter, _ := formatterForStdin(); formatter == nil || !formatter.canFormat() {
+		switch *stdinFallback {
+		case "passthrough":
+			if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+				log.Fatalln(err)
+			}
+
+			return
+		case "silent":
+			return
+		}
+	}
+
+	if *filterMode {
+		formatFilter()
+		return
+	}
+
+	formatter, path := formatterForStdin()
+	if formatter == nil {
+		log.Fatalln("Must be given an Emacs major mode or a file name")
+	}
+
+	if err := formatValidate(os.Stdout, os.Stdin, path, formatter); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// formatFilter formats standard input like formatStdin but, on failure, writes the original input
+// to standard output so that editors using metafmt as a filter don't lose the buffer contents.
+func formatFilter() {
+	src, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var buf bytes.Buffer
+
+	if formatter, path := formatterForStdin(); formatter == nil {
+		err = errors.New("Must be given an Emacs major mode or a file name")
+	} else {
+		err = formatValidate(&buf, bytes.NewReader(src), path, formatter)
+	}
+
+	if err != nil {
+		os.Stdout.Write(src)
+		log.Fatalln(err)
+	}
+
+	os.Stdout.Write(buf.Bytes())
+}
+
+// formatBatch reads records made of a file name and the file's content, each terminated by a NUL
+// byte, from standard input. It writes the same records to standard output with the content
+// formatted according to the file name. Content that can't be formatted is written back as is.
+func formatBatch() {
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+
+	for {
+		name, err := in.ReadBytes(0)
+		if err == io.EOF && len(name) == 0 {
+			return
+		}
+
+		var content []byte
+		if err == nil {
+			content, err = in.ReadBytes(0)
+		}
+
+		if err != nil {
+			log.Fatalln("Truncated batch record:", err)
+		}
+
+		name, content = name[:len(name)-1], content[:len(content)-1]
+
+		formatted := content
+		if formatter := formatterForPath(string(name)); formatter != nil && formatter.available() {
+			var buf bytes.Buffer
+
+			if err := formatValidate(&buf, bytes.NewReader(content), string(name), formatter); err != nil {
+				log.Println(err)
+			} else {
+				formatted = buf.Bytes()
+			}
+		}
+
+		out.Write(name)
+		out.WriteByte(0)
+		out.Write(formatted)
+		out.WriteByte(0)
+
+		if err := out.Flush(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// formatterForStdin selects the formatter for standard input, preferring the one for the file
+// name given with -stdin-filepath unless it doesn't handle the major mode given with -emacs. It
+// also returns the path to use in place of the file name: when one isn't given, a made-up file
+// name with the formatter's extension.
+func formatterForStdin() (*formatter, string) {
+	if *stdinFilepath != "" {
+		formatter := formatterForFilename(*stdinFilepath)
+		if formatter == nil {
+			formatter = formatterForExt(*stdinFilepath)
+		}
+
+		// The major mode tells apart the languages sharing an extension, like Coq, V and Verilog
+		if major := formatterForEmacs(); major != nil && (formatter == nil || !dry.StringListContains(formatter.EmacsMajorModes, *emacs)) {
+			formatter = major
+		}
+
+		if formatter = applyOverride(*stdinFilepath, formatter); formatter == nil {
+			return nil, ""
+		}
+
+		return formatter, *stdinFilepath
+	}
+
+	formatter := formatterForEmacs()
+	if formatter == nil {
+		return nil, ""
+	}
+
+	path := "stdin"
+	if len(formatter.Extensions) > 0 {
+		path += formatter.Extensions[0]
+	}
+
+	return formatter, path
+}
+
+//
+// Low level operations
+//
+
+func formatWrite(path string, formatter *formatter) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	src, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	if err := formatValidate(&buf, bytes.NewReader(src), path, formatter); err != nil {
+		return err
+	}
+
+	if bytes.Equal(src, buf.Bytes()) {
+		return nil
+	}
+
+	if buf.Len() == 0 && !*allowEmptyOutput {
+		return fmt.Errorf("%s: formatter output is empty, leaving the file as is (see -allow-empty-output)", path)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, &buf); err != nil {
+		return err
+	}
+
+	return recordModified(path)
+}
+
+// formatCheckIdempotent formats the file twice, printing the differences between the two results.
+func formatCheckIdempotent(path string, formatter *formatter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var once, twice bytes.Buffer
+
+	if err := formatValidate(&once, file, path, formatter); err != nil {
+		return err
+	}
+
+	if err := formatValidate(&twice, bytes.NewReader(once.Bytes()), path, formatter); err != nil {
+		return err
+	}
+
+	if diff := unifiedDiff(path+" (formatted once)", path+" (formatted twice)", once.Bytes(), twice.Bytes()); diff != nil {
+		// Like formatCheck, so that the output of files formatted in parallel isn't mixed up
+		unformattedMutex.Lock()
+		defer unformattedMutex.Unlock()
+
+		log.Printf("%s: formatting isn't idempotent", path)
+		atomic.StoreInt32(&failed, 1)
+
+		if err := writeDiff(diff); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkResult describes a file that formatCheck found wasn't formatted.
+type checkResult struct {
+	Path string `json:"path"`
+	Diff string `json:"diff,omitempty"`
+}
+
+var unformatted []checkResult
+
+// unformattedMutex guards unformatted, and serializes what checks write when files are checked
+// in parallel.
+var unformattedMutex sync.Mutex
+
+// ciDocsURL documents how to format files locally, for failures in -ci mode.
+const ciDocsURL = "https://github.com/lvillani/metafmt#continuous-integration"
+
+// formatCheck compares the file with the result of formatting it. Files that would change are
+// listed or, with -diff, shown as differences, unless -json collects them for writeCheckReport.
+// With -check they also make metafmt exit with a non-zero status.
+func formatCheck(path string, formatter *formatter) error {
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var formatted bytes.Buffer
+	if err := formatValidate(&formatted, bytes.NewReader(original), path, formatter); err != nil {
+		return err
+	}
+
+	if bytes.Equal(original, formatted.Bytes()) {
+		return nil
+	}
+
+	result := checkResult{Path: path}
+	if *showDiff {
+		result.Diff = string(unifiedDiff(path+" (original)", path+" (formatted)", original, formatted.Bytes()))
+	}
+
+	unformattedMutex.Lock()
+	defer unformattedMutex.Unlock()
+
+	unformatted = append(unformatted, result)
+
+	if !*jsonOutput {
+		if *showDiff {
+			if err := writeDiff([]byte(result.Diff)); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println(path)
+		}
+	}
+
+	if *check {
+		atomic.StoreInt32(&failed, 1)
+	}
+
+	return nil
+}
+
+// writeDiff writes diff to standard output, through the program given with -diff-tool if any.
+func writeDiff(diff []byte) error {
+	tool := strings.Fields(*diffTool)
+	if len(tool) == 0 {
+		_, err := os.Stdout.Write(diff)
+		return err
+	}
+
+	cmd := exec.Command(tool[0], tool[1:]...)
+	cmd.Stdin = bytes.NewReader(diff)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", tool[0], err)
+	}
+
+	return nil
+}
+
+// checkResults returns the files found by formatCheck, sorted by path.
+func checkResults() []checkResult {
+	results := append([]checkResult{}, unformatted...)
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+
+	return results
+}
+
+// writeCheckReport writes the files found by formatCheck as a JSON array, sorted by path.
+func writeCheckReport(w io.Writer) error {
+	data, err := json.MarshalIndent(checkResults(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// writeReportFile saves the files found by formatCheck in the JSON report at path, after the
+// results of previous runs unless -report-overwrite is given. The report is replaced atomically,
+// by renaming a temporary file written next to it.
+func writeReportFile(path string) error {
+	var results []checkResult
+
+	if !*reportOverwrite {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &results); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+
+	results = append(results, checkResults()...)
+	if results == nil {
+		results = []checkResult{}
+	}
 
-type lookupMap map[string]*formatter
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
 
-var emacsToFormatter = make(lookupMap)
-var extToFormatter = make(lookupMap)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".metafmt-report-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
 
-func init() {
-	for _, formatter := range formatters {
-		for _, ext := range formatter.Extensions {
-			extToFormatter[ext] = formatter
-		}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
 
-		for _, majorMode := range formatter.EmacsMajorModes {
-			emacsToFormatter[majorMode] = formatter
-		}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
 	}
+
+	return os.Rename(tmp.Name(), path)
 }
 
-func formatterForEmacs() *formatter {
-	if *emacs == "" {
+// failed is set when a check fails or a file can't be formatted, making metafmt exit with a
+// non-zero status.
+var failed int32
+
+var manifest *os.File
+var manifestMutex sync.Mutex
+
+// recordModified appends the absolute path of a file overwritten by formatWrite to the manifest
+// given with -write-manifest, if any.
+func recordModified(path string) error {
+	if manifest == nil {
 		return nil
 	}
 
-	formatter, ok := emacsToFormatter[*emacs]
-	if !ok {
-		return nil
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
 	}
 
-	return formatter
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+
+	_, err = fmt.Fprintln(manifest, abs)
+	return err
 }
 
-func formatterForPath(path string) *formatter {
-	ext := filepath.Ext(path)
-	if ext == "" {
-		return nil
+func formatStdout(path string, formatter *formatter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	fmt, ok := extToFormatter[ext]
-	if !ok {
-		return nil
+	return formatValidate(os.Stdout, file, path, formatter)
+}
+
+// formatValidate formats src and runs the formatter's validators on the result. Validation
+// failures are logged as warnings: the formatted output is written regardless.
+func formatValidate(dst io.Writer, src io.Reader, path string, formatter *formatter) error {
+	var frontMatter []byte
+
+	if formatter.StripFrontMatter {
+		data, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+
+		var body []byte
+		frontMatter, body = splitFrontMatter(data)
+		src = bytes.NewReader(body)
+	}
+
+	var buf bytes.Buffer
+
+	if err := formatter.run(&buf, src, path); err != nil {
+		return err
+	}
+
+	formatExtras(&buf, path, formatter)
+
+	if (*appendNewline || config.AppendNewline) && buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	formatted := append(frontMatter[:len(frontMatter):len(frontMatter)], buf.Bytes()...)
+
+	validators, err := expandCommands(formatter.Validators, path, false)
+	if err != nil {
+		return err
+	}
+
+	for _, command := range validators {
+		if err := validate(formatted, command); err != nil {
+			log.Printf("%s: %s: %s", path, command[0], err)
+		}
 	}
 
-	return fmt
+	_, err = dst.Write(formatted)
+	return err
 }
 
-//
-// Flags
-//
+// run formats src into dst with the native function of the formatter or its command chain.
+func (f *formatter) run(dst io.Writer, src io.Reader, path string) error {
+	if f.NativeFunc != nil {
+		return f.NativeFunc(dst, src)
+	}
 
-var emacs = flag.String("emacs", "", "Emacs major mode")
-var write = flag.Bool("write", false, "Write the file in place")
+	if len(f.Commands) == 0 {
+		return fmt.Errorf("%s: no formatter is available for %s yet", path, f.Language)
+	}
 
-//
-// Entry point
-//
+	commands := f.commands()
+	if commands == nil {
+		return fmt.Errorf("%s: %s is not installed", path, f.Commands[0][0])
+	}
 
-type formatOp func(string, *formatter) error
+	// The options named by the formatter are those of its own command, not of its fallbacks
+	if commands[0][0] == f.Commands[0][0] {
+		commands = appendArgs(commands, f.localArgs(path))
+		commands = f.lineWidthCommands(commands)
+	}
 
-func main() {
-	// Flags
-	flag.Parse()
+	commands = appendArgs(commands, f.AdditionalArgs)
 
-	args := flag.Args()
-	if len(args) < 1 {
-		return
+	if f.Shell {
+		commands = shellCommands(commands)
 	}
 
-	// Format standard input, then stop
-	if len(args) == 1 && args[0] == "-" {
-		formatStdin()
-		return
+	if f.FileMode {
+		return formatTempFile(dst, src, path, commands, f.Shell)
 	}
 
-	// Select mode of operation (format to file or standard output)
-	var op formatOp
-	if *write {
-		op = formatWrite
-	} else {
-		op = formatStdout
+	expanded, err := expandCommands(commands, path, f.Shell)
+	if err != nil {
+		return err
 	}
 
-	// Format files
-	for _, path := range args {
-		if dry.FileIsDir(path) {
-			formatDir(path, op)
-		} else {
-			formatFile(path, op)
+	return formatChain(dst, src, expanded)
+}
+
+// program returns the name of the program the formatter runs first.
+func (f *formatter) program() string {
+	if f.Shell {
+		return "sh"
+	}
+
+	return f.Commands[0][0]
+}
+
+// canFormat reports whether the formatter has a way of formatting files, unlike those of languages
+// that have no formatter yet.
+func (f *formatter) canFormat() bool {
+	return f.NativeFunc != nil || len(f.Commands) > 0
+}
+
+// available reports whether the formatter can run, that is whether it is native or the programs
+// of its command chain or one of its fallbacks are installed.
+func (f *formatter) available() bool {
+	return f.NativeFunc != nil || f.commands() != nil
+}
+
+// formatExtras runs the optional steps of formatter enabled in the configuration file on buf.
+// Steps whose program isn't installed are skipped; when a step fails, a warning is logged and
+// buf is left as it was.
+func formatExtras(buf *bytes.Buffer, path string, formatter *formatter) {
+	for _, name := range config.Extras {
+		command, ok := formatter.Extras[name]
+		if !ok || !installed([][]string{command}) {
+			continue
+		}
+
+		expanded, err := expandCommands([][]string{command}, path, false)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
+
+		var out bytes.Buffer
+
+		if err := format(&out, bytes.NewReader(buf.Bytes()), expanded[0]); err != nil {
+			log.Printf("%s: %s: %s", path, name, err)
+			continue
+		}
+
+		buf.Reset()
+		buf.Write(out.Bytes())
 	}
 }
 
-//
-// High level operations
-//
+// splitFrontMatter splits the YAML ("---") or TOML ("+++") front matter at the beginning of a
+// document, delimiters included, from its body.
+func splitFrontMatter(src []byte) (frontMatter, body []byte) {
+	lines := bytes.SplitAfter(src, []byte("\n"))
 
-var IgnoreDirs = []string{".git", ".hg", ".svn", "node_modules"}
+	delimiter := bytes.TrimRight(lines[0], "\r\n")
+	if string(delimiter) != "---" && string(delimiter) != "+++" {
+		return nil, src
+	}
 
-func formatDir(path string, op formatOp) {
-	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() && dry.StringListContains(IgnoreDirs, info.Name()) {
-			return filepath.SkipDir
+	n := len(lines[0])
+	for _, line := range lines[1:] {
+		n += len(line)
+
+		if bytes.Equal(bytes.TrimRight(line, "\r\n"), delimiter) {
+			return src[:n], src[n:]
 		}
+	}
 
-		if !info.IsDir() {
-			formatFile(path, op)
+	return nil, src
+}
+
+// commands returns the command chain to run: Commands or, when one of the programs it runs isn't
+// installed, the first of Fallbacks that is. It returns nil when none of them is installed.
+func (f *formatter) commands() [][]string {
+	if f.Shell {
+		if installed([][]string{{"sh"}}) {
+			return f.Commands
 		}
 
 		return nil
-	})
-}
+	}
 
-func formatFile(path string, op formatOp) {
-	formatter := formatterForPath(path)
-	if formatter == nil {
-		return
+	if installed(f.Commands) {
+		return f.Commands
 	}
 
-	if err := op(path, formatter); err != nil {
-		log.Fatalln(err)
+	for _, fallback := range f.Fallbacks {
+		if chain := [][]string{fallback}; installed(chain) {
+			return chain
+		}
 	}
+
+	return nil
 }
 
-func formatStdin() {
-	formatter := formatterForEmacs()
-	if formatter == nil {
-		log.Fatalln("Must be given an Emacs major mode")
+// localArgs returns the options telling the formatter which imports belong to the module given
+// with -local or, with -auto-local, to the Go module containing path, if it supports grouping
+// them.
+func (f *formatter) localArgs(path string) []string {
+	if f.LocalFlag == "" {
+		return nil
 	}
 
-	if err := formatChain(os.Stdout, os.Stdin, formatter.Commands); err != nil {
-		log.Fatalln(err)
+	module := localModule(path)
+	if module == "" {
+		return nil
+	}
+
+	return []string{f.LocalFlag, module}
+}
+
+// localModule returns the module given with -local or, with -auto-local, the Go module
+// containing path.
+func localModule(path string) string {
+	if *local == "" && *autoLocal {
+		return goModulePath(filepath.Dir(path))
 	}
+
+	return *local
 }
 
-//
-// Low level operations
-//
+var goModulePaths = make(map[string]string)
+var goModulePathsMutex sync.Mutex
 
-func formatWrite(path string, formatter *formatter) error {
-	file, err := os.OpenFile(path, os.O_RDWR, 0)
+// goModulePath returns the module path declared by the go.mod file found in dir or one of its
+// parents, or an empty string if there is none. Results are cached by directory.
+func goModulePath(dir string) string {
+	dir, err := filepath.Abs(dir)
 	if err != nil {
-		return err
+		return ""
 	}
-	defer file.Close()
 
-	var buf bytes.Buffer
+	goModulePathsMutex.Lock()
+	defer goModulePathsMutex.Unlock()
 
-	if err := formatChain(&buf, file, formatter.Commands); err != nil {
-		return err
+	var visited []string
+	var module string
+
+	for {
+		if cached, ok := goModulePaths[dir]; ok {
+			module = cached
+			break
+		}
+
+		visited = append(visited, dir)
+
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			module = parseModulePath(data)
+			break
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+
+		dir = parent
 	}
 
-	if err := file.Truncate(0); err != nil {
-		return err
+	for _, dir := range visited {
+		goModulePaths[dir] = module
 	}
 
-	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
-		return err
+	return module
+}
+
+// parseModulePath returns the path given by the module directive of a go.mod file.
+func parseModulePath(goMod []byte) string {
+	for _, line := range strings.Split(string(goMod), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], "\"`")
+		}
 	}
 
-	_, err = io.Copy(file, &buf)
-	return err
+	return ""
 }
 
-func formatStdout(path string, formatter *formatter) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
+// lineWidthCommands returns commands with the first one given the line length set with
+// -line-length, if the formatter supports it. When the command already sets one, as a default,
+// its value is replaced.
+func (f *formatter) lineWidthCommands(commands [][]string) [][]string {
+	if f.LineWidthFlag == "" || *lineLength <= 0 {
+		return commands
+	}
+
+	width := strconv.Itoa(*lineLength)
+
+	for i, arg := range commands[0] {
+		if arg == f.LineWidthFlag && i+1 < len(commands[0]) {
+			first := append([]string{}, commands[0]...)
+			first[i+1] = width
+
+			return append([][]string{first}, commands[1:]...)
+		}
+	}
+
+	return appendArgs(commands, []string{f.LineWidthFlag, width})
+}
+
+// shellCommands turns each of commands into an sh -c invocation of its arguments joined with
+// spaces, so that they can use pipes, redirections and the like. The values of their templates are
+// quoted by expandCommands.
+func shellCommands(commands [][]string) [][]string {
+	wrapped := make([][]string, len(commands))
+	for i, command := range commands {
+		wrapped[i] = []string{"sh", "-c", strings.Join(command, " ")}
+	}
+
+	return wrapped
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// appendArgs returns commands with args added to the end of the first command, leaving commands
+// itself untouched since it is shared by all files.
+func appendArgs(commands [][]string, args []string) [][]string {
+	if len(args) == 0 {
+		return commands
+	}
+
+	first := append(append([]string{}, commands[0]...), args...)
+	return append([][]string{first}, commands[1:]...)
+}
+
+var installedPrograms = make(map[string]bool)
+var installedProgramsMutex sync.Mutex
+
+// installed reports whether all the programs run by commands can be found in $PATH.
+func installed(commands [][]string) bool {
+	installedProgramsMutex.Lock()
+	defer installedProgramsMutex.Unlock()
+
+	for _, command := range commands {
+		found, ok := installedPrograms[command[0]]
+		if !ok {
+			_, err := exec.LookPath(command[0])
+			found = err == nil
+			installedPrograms[command[0]] = found
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commandData is what the templates of command arguments can refer to, as in {{.Filename}}.
+type commandData struct {
+	Filename  string // Path of the file being formatted
+	Ext       string // Its extension, as in ".go"
+	Dir       string // The directory containing it
+	LineWidth int    // Line length given with -line-length, 0 if none
+	Module    string // Go module given with -local or found with -auto-local
+}
+
+// expandCommands renders the arguments of commands as templates of commandData for path. With
+// shell, the values are quoted for commands run by sh -c, so that file names can't inject code.
+func expandCommands(commands [][]string, path string, shell bool) ([][]string, error) {
+	data := commandData{
+		Filename:  path,
+		Ext:       filepath.Ext(path),
+		Dir:       filepath.Dir(path),
+		LineWidth: *lineLength,
+		Module:    localModule(path),
 	}
-	defer file.Close()
 
-	return formatChain(os.Stdout, file, formatter.Commands)
+	if shell {
+		data.Filename = shellQuote(data.Filename)
+		data.Ext = shellQuote(data.Ext)
+		data.Dir = shellQuote(data.Dir)
+		data.Module = shellQuote(data.Module)
+	}
+
+	expanded := make([][]string, len(commands))
+
+	for i, command := range commands {
+		expanded[i] = make([]string, len(command))
+
+		for j, arg := range command {
+			if !strings.Contains(arg, "{") {
+				expanded[i][j] = arg
+				continue
+			}
+
+			arg = strings.Replace(arg, legacyFilenamePlaceholder, filenamePlaceholder, -1)
+
+			tmpl, err := template.New(command[0]).Option("missingkey=error").Parse(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, data); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+
+			expanded[i][j] = buf.String()
+		}
+	}
+
+	return expanded, nil
 }
 
 func formatChain(dst io.Writer, src io.Reader, commandChain [][]string) error {
@@ -316,6 +2199,45 @@ func formatChain(dst io.Writer, src io.Reader, commandChain [][]string) error {
 	return err
 }
 
+// formatTempFile copies src to a temporary file with the same extension as path, on which it runs
+// commands. These are expected to format the file in place, and to be given its path in place of
+// filenamePlaceholder. The content of the temporary file is then copied to dst.
+func formatTempFile(dst io.Writer, src io.Reader, path string, commands [][]string, shell bool) error {
+	tmp, err := ioutil.TempFile("", "metafmt-*"+filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	expanded, err := expandCommands(commands, tmp.Name(), shell)
+	if err != nil {
+		return err
+	}
+
+	for _, command := range expanded {
+		if err := format(ioutil.Discard, nil, command); err != nil {
+			return err
+		}
+	}
+
+	formatted, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	_, err = dst.Write(formatted)
+	return err
+}
+
 func format(dst io.Writer, src io.Reader, command []string) error {
 	cmd := exec.Command(command[0], command[1:]...)
 	cmd.Stdin = src
@@ -327,3 +2249,18 @@ func format(dst io.Writer, src io.Reader, command []string) error {
 
 	return nil
 }
+
+func validate(src []byte, command []string) error {
+	var out bytes.Buffer
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(src)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err, bytes.TrimSpace(out.Bytes()))
+	}
+
+	return nil
+}
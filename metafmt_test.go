@@ -0,0 +1,887 @@
+//
+// Copyright (c) 2015 Lorenzo Villani
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+//
+// Fixtures
+//
+
+// TestFormatters formats each "NAME.before" file of testdata as if it were NAME, like metafmt
+// does, and compares the result with "NAME.after". Formatters that aren't installed are skipped.
+func TestFormatters(t *testing.T) {
+	befores, err := filepath.Glob(filepath.Join("testdata", "*.before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, before := range befores {
+		path := strings.TrimSuffix(before, ".before")
+
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			formatter := formatterForPath(path)
+			if formatter == nil {
+				t.Fatalf("no formatter for %s", path)
+			}
+
+			if !formatter.available() {
+				t.Skipf("%s is not installed", formatter.program())
+			}
+
+			src, err := ioutil.ReadFile(before)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := ioutil.ReadFile(path + ".after")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got bytes.Buffer
+			if err := formatValidate(&got, bytes.NewReader(src), path, formatter); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := unifiedDiff(path+".after", path+" (formatted)", want, got.Bytes()); diff != nil {
+				t.Errorf("unexpected output:\n%s", diff)
+			}
+		})
+	}
+}
+
+//
+// Native formatters
+//
+
+type nativeTest struct {
+	in, want string
+	err      bool
+}
+
+func testNative(t *testing.T, format nativeFunc, tests []nativeTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		err := format(&out, strings.NewReader(test.in))
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.in, out.String())
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		} else if out.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, out.String(), test.want)
+		}
+	}
+}
+
+func TestFormatCommitMsg(t *testing.T) {
+	testNative(t, formatCommitMsg, []nativeTest{
+		{in: "feat: add x\n", want: "feat: add x\n"},
+		{in: "Feat(api) : Add x.  \nBody\n", want: "feat(api): Add x\n\nBody\n"},
+		{in: "fix!: drop y\n\nBody\n", want: "fix!: drop y\n\nBody\n"},
+		{in: "# Comment\n\nchore: z\n", want: "# Comment\n\nchore: z\n"},
+		{in: "Merge branch 'dev'\n", want: "Merge branch 'dev'\n"},
+		{in: "Revert \"feat: add x\"\nBody\n", want: "Revert \"feat: add x\"\nBody\n"},
+		{in: "fixup! feat: add x\n", want: "fixup! feat: add x\n"},
+		{in: "Add x\n", err: true},
+		{in: "feat: .\n", err: true},
+	})
+}
+
+func TestFormatTcl(t *testing.T) {
+	testNative(t, formatTcl, []nativeTest{
+		{in: "", want: ""},
+		{in: "proc p {} {\nputs x  \n}\n", want: "proc p {} {\n    puts x\n}\n"},
+		{in: "if {1} {\n  if {2} {\nputs x\n  }\n}\n", want: "if {1} {\n    if {2} {\n        puts x\n    }\n}\n"},
+		{in: "puts \\{\nputs x\n", want: "puts \\{\nputs x\n"},
+		{in: "# {\nputs x\n", want: "# {\nputs x\n"},
+		{in: "set x [list \\\na b]\nputs x\n", want: "set x [list \\\n    a b]\nputs x\n"},
+		{in: "}\nputs x\n", want: "}\nputs x\n"},
+		{in: "puts x\n \n", want: "puts x\n"},
+	})
+}
+
+func TestFormatDotenv(t *testing.T) {
+	testNative(t, formatDotenv, []nativeTest{
+		{in: "", want: ""},
+		{in: "A = 1  \n", want: "A=1\n"},
+		{in: "A=1\r\nB = 2\r\n", want: "A=1\r\nB=2\r\n"},
+		{in: "export A=x y\n", want: "export A=\"x y\"\n"},
+		{in: "A=1\nB=2\nA=3\n", want: "B=2\nA=3\n"},
+		{in: "A='x'  # Comment\n", want: "A='x' # Comment\n"},
+		{in: "A=x # Comment\n", want: "A=x # Comment\n"},
+		{in: "A=\"x\n  y\"\nB = 1\n", want: "A=\"x\n  y\"\nB=1\n"},
+		{in: "# Comment\n\nnot an assignment\n", want: "# Comment\n\nnot an assignment\n"},
+	})
+}
+
+func TestFormatDotenvSorted(t *testing.T) {
+	testNative(t, formatDotenvSorted, []nativeTest{
+		{in: "", want: ""},
+		{in: "B=1\n\n# A's comment\nA=2\n", want: "# A's comment\nA=2\nB=1\n"},
+		{in: "# Header\n\nB=1\nA=2\n", want: "# Header\n\nA=2\nB=1\n"},
+		{in: "B=1\r\nA=2\r\n", want: "A=2\r\nB=1\r\n"},
+		{in: "B='line1\nline2'   \nA=1\n", want: "A=1\nB='line1\nline2'\n"},
+	})
+}
+
+// FuzzNative checks that the native formatters don't panic, and that formatting their output
+// again doesn't change it.
+func FuzzNative(f *testing.F) {
+	for _, seed := range []string{
+		"feat(api): add x\n\nBody\n",
+		"proc p {} {\nputs \\{\n}\n",
+		"# Comment\nexport A = x y # z\nB='a\nb'\nA=1\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	natives := map[string]nativeFunc{
+		"commit-msg":    formatCommitMsg,
+		"dotenv":        formatDotenv,
+		"dotenv-sorted": formatDotenvSorted,
+		"tcl":           formatTcl,
+	}
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		for name, format := range natives {
+			var once, twice bytes.Buffer
+
+			if err := format(&once, bytes.NewReader(src)); err != nil {
+				continue
+			}
+
+			if err := format(&twice, bytes.NewReader(once.Bytes())); err != nil {
+				t.Fatalf("%s: formatting %q again: %v", name, once.Bytes(), err)
+			}
+
+			if !bytes.Equal(once.Bytes(), twice.Bytes()) {
+				t.Fatalf("%s: %q formatted as %q, then as %q", name, src, once.Bytes(), twice.Bytes())
+			}
+		}
+	})
+}
+
+//
+// Diffs
+//
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"a\n", "a\n", ""},
+		{"a\nb\nc\n", "a\nB\nc\n", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"a", "b", "--- a\n+++ b\n@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+b\n\\ No newline at end of file\n"},
+		{"", "x\n", "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n"},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			"--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+	}
+
+	for _, test := range tests {
+		if got := string(unifiedDiff("a", "b", []byte(test.a), []byte(test.b))); got != test.want {
+			t.Errorf("%q, %q: got %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestUnifiedDiffTooLarge(t *testing.T) {
+	b := strings.Repeat("x\n", maxDiffLines+1)
+
+	if got := string(unifiedDiff("a", "b", nil, []byte(b))); !strings.Contains(got, "too many lines") {
+		t.Errorf("got %q", got)
+	}
+}
+
+// FuzzUnifiedDiff checks that diffs don't panic, and that the edit script they are made from turns
+// one text into the other.
+func FuzzUnifiedDiff(f *testing.F) {
+	f.Add([]byte("a\nb\nc\n"), []byte("a\nB\nc"))
+	f.Add([]byte(""), []byte("x\n"))
+
+	f.Fuzz(func(t *testing.T, a, b []byte) {
+		if diff := unifiedDiff("a", "b", a, b); (diff == nil) != bytes.Equal(a, b) {
+			t.Fatalf("%q, %q: got %q", a, b, diff)
+		}
+
+		var gotA, gotB []byte
+		for _, op := range diffLines(splitLines(a), splitLines(b)) {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line...)
+			}
+
+			if op.kind != '-' {
+				gotB = append(gotB, op.line...)
+			}
+		}
+
+		if !bytes.Equal(gotA, a) || !bytes.Equal(gotB, b) {
+			t.Fatalf("%q, %q: edit script gives %q and %q", a, b, gotA, gotB)
+		}
+	})
+}
+
+//
+// Paths and configuration
+//
+
+func TestExtensions(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"main.go", []string{".go"}},
+		{"src/button.module.css", []string{".module.css", ".css"}},
+		{".eslintrc.json", []string{".json"}},
+		{"Makefile", nil},
+		{"dir.d/Makefile", nil},
+	}
+
+	for _, test := range tests {
+		if got := extensions(test.path); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestFormatterForPath(t *testing.T) {
+	tests := []struct {
+		path, language string
+	}{
+		{"main.go", "Go"},
+		{".env", "dotenv"},
+		{"config/.env.local", "dotenv"},
+		{"prod.env", "dotenv"},
+		{".env.json", "JSON"},
+		{"Caddyfile", "Caddyfile"},
+		{"Caddyfile.prod", "Caddyfile"},
+		{"/etc/nginx/sites-enabled/default.conf", "Nginx"},
+		{"openapi.json", "JSON"},
+		{"README", ""},
+	}
+
+	for _, test := range tests {
+		language := ""
+		if formatter := formatterForPath(test.path); formatter != nil {
+			language = formatter.Language
+		}
+
+		if language != test.language {
+			t.Errorf("%s: got %q, want %q", test.path, language, test.language)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**/vendor", "vendor", true},
+		{"**/vendor", "a/b/vendor", true},
+		{"**/vendor", "vendor/a", false},
+		{"src/*.go", "src/a.go", true},
+		{"src/*.go", "src/a/b.go", false},
+		{"src/**/*.go", "src/a.go", true},
+		{"src/**/*.go", "src/a/b/c.go", true},
+		{"*.go", "a.txt", false},
+	}
+
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.name); got != test.want {
+			t.Errorf("%s, %s: got %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  byteSize
+		err   bool
+	}{
+		{value: "0", want: 0},
+		{value: "512", want: 512},
+		{value: "1k", want: 1 << 10},
+		{value: "2M", want: 2 << 20},
+		{value: "1g", want: 1 << 30},
+		{value: "", err: true},
+		{value: "k", err: true},
+		{value: "-1", err: true},
+		{value: "1x", err: true},
+		{value: "1.5k", err: true},
+	}
+
+	for _, test := range tests {
+		var b byteSize
+
+		err := b.Set(test.value)
+		if test.err != (err != nil) {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+		} else if b != test.want {
+			t.Errorf("%q: got %d, want %d", test.value, b, test.want)
+		}
+	}
+}
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		src, frontMatter, body string
+	}{
+		{"---\ntitle: x\n---\nBody\n", "---\ntitle: x\n---\n", "Body\n"},
+		{"+++\ntitle = 'x'\n+++\n", "+++\ntitle = 'x'\n+++\n", ""},
+		{"---\r\ntitle: x\r\n---\r\nBody", "---\r\ntitle: x\r\n---\r\n", "Body"},
+		{"---\nunterminated\n", "", "---\nunterminated\n"},
+		{"Body\n---\n", "", "Body\n---\n"},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		frontMatter, body := splitFrontMatter([]byte(test.src))
+		if string(frontMatter) != test.frontMatter || string(body) != test.body {
+			t.Errorf("%q: got %q and %q, want %q and %q", test.src, frontMatter, body, test.frontMatter, test.body)
+		}
+	}
+}
+
+func TestParseModulePath(t *testing.T) {
+	tests := []struct {
+		goMod, want string
+	}{
+		{"module example.com/m\n\ngo 1.21\n", "example.com/m"},
+		{"// Comment\nmodule \"example.com/m\"\n", "example.com/m"},
+		{"module example.com/m // Comment\n", "example.com/m"},
+		{"go 1.21\n", ""},
+	}
+
+	for _, test := range tests {
+		if got := parseModulePath([]byte(test.goMod)); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.goMod, got, test.want)
+		}
+	}
+}
+
+func TestExpandCommands(t *testing.T) {
+	tests := []struct {
+		command []string
+		path    string
+		shell   bool
+		want    []string
+	}{
+		{
+			[]string{"tool", "--stdin-filepath", "{{.Filename}}", "-"},
+			"src/a b.go", false,
+			[]string{"tool", "--stdin-filepath", "src/a b.go", "-"},
+		},
+		{
+			[]string{"tool", "{filename}", "{{.Ext}}", "{{.Dir}}", "{{.LineWidth}}"},
+			"src/a.go", false,
+			[]string{"tool", "src/a.go", ".go", "src", "0"},
+		},
+		{
+			[]string{"sh", "-c", "echo {{.Filename}} && cat"},
+			"a;touch x;it's.sh", true,
+			[]string{"sh", "-c", `echo 'a;touch x;it'\''s.sh' && cat`},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := expandCommands([][]string{test.command}, test.path, test.shell)
+		if err != nil {
+			t.Errorf("%q: %v", test.command, err)
+		} else if !reflect.DeepEqual(got[0], test.want) {
+			t.Errorf("%q: got %q, want %q", test.command, got[0], test.want)
+		}
+	}
+
+	for _, arg := range []string{"{{.Unknown}}", "{{.Filename"} {
+		if _, err := expandCommands([][]string{{"tool", arg}}, "a.go", false); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
+
+//
+// Standard input
+//
+
+// setFlag sets the flag pointed to by p to value until the end of the test.
+func setFlag(t *testing.T, p *string, value string) {
+	previous := *p
+	*p = value
+
+	t.Cleanup(func() { *p = previous })
+}
+
+func TestFormatterForStdin(t *testing.T) {
+	tests := []struct {
+		emacs, path      string
+		language, stdout string
+	}{
+		{"", "top.v", "V", "top.v"},
+		{"verilog-mode", "top.v", "Verilog", "top.v"},
+		{"coq-mode", "proof.v", "Coq", "proof.v"},
+		{"v-mode", "main.v", "V", "main.v"},
+		{"go-mode", "", "Go", "stdin.go"},
+		{"unknown-mode", "main.go", "Go", "main.go"},
+	}
+
+	// Coq is experimental
+	*experimental = true
+	defer func() { *experimental = false }()
+
+	for _, test := range tests {
+		setFlag(t, emacs, test.emacs)
+		setFlag(t, stdinFilepath, test.path)
+
+		formatter, path := formatterForStdin()
+		if formatter == nil {
+			t.Errorf("%s, %s: no formatter", test.emacs, test.path)
+		} else if formatter.Language != test.language || path != test.stdout {
+			t.Errorf("%s, %s: got %s for %s, want %s for %s", test.emacs, test.path, formatter.Language, path, test.language, test.stdout)
+		}
+	}
+}
+
+//
+// Options
+//
+
+func TestLineWidthCommands(t *testing.T) {
+	erb := formatterForLanguage("ERB")
+	commands := erb.Commands
+
+	if got := erb.lineWidthCommands(commands); !reflect.DeepEqual(got, commands) {
+		t.Errorf("without -line-length: got %q", got)
+	}
+
+	*lineLength = 80
+	defer func() { *lineLength = 0 }()
+
+	want := [][]string{{"erb-format", "--print-width", "80", "-"}}
+	if got := erb.lineWidthCommands(commands); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if !reflect.DeepEqual(erb.Commands[0], []string{"erb-format", "--print-width", "100", "-"}) {
+		t.Errorf("default command changed to %q", erb.Commands[0])
+	}
+
+	want = [][]string{{"prettier", "--parser", "css", "--print-width", "80"}}
+	css := &formatter{Commands: [][]string{{"prettier", "--parser", "css"}}, LineWidthFlag: "--print-width"}
+	if got := css.lineWidthCommands(css.Commands); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+//
+// Configuration file
+//
+
+// setConfig replaces the configuration with c, as if it had been read from dir, until the end of
+// the test.
+func setConfig(t *testing.T, c Config, dir string) {
+	previous, previousDir := config, configDir
+	config, configDir = c, dir
+
+	t.Cleanup(func() { config, configDir = previous, previousDir })
+}
+
+func TestOverrideApply(t *testing.T) {
+	disabled := false
+	if got := (&Override{Enabled: &disabled}).apply(formatterForLanguage("Go")); got != nil {
+		t.Errorf("Enabled = false: got %s", got.Language)
+	}
+
+	for _, f := range []*formatter{nil, formatterForLanguage("Go")} {
+		if got := (&Override{Language: "JSON"}).apply(f); got == nil || got.Language != "JSON" {
+			t.Errorf("Language = JSON: got %v", got)
+		}
+	}
+
+	clojure := formatterForLanguage("Clojure")
+	commands := [][]string{{"cat"}}
+
+	got := (&Override{Commands: commands}).apply(clojure)
+	if got == nil || !reflect.DeepEqual(got.Commands, commands) || got.Fallbacks != nil {
+		t.Errorf("Commands: got %v", got)
+	}
+
+	if clojure.Fallbacks == nil || reflect.DeepEqual(clojure.Commands, commands) {
+		t.Error("Commands: the built-in formatter was changed")
+	}
+
+	if got := (&Override{Native: "identity"}).apply(nil); got == nil || got.NativeFunc == nil {
+		t.Errorf("Native = identity: got %v", got)
+	}
+
+	if got := (&Override{AdditionalArgs: []string{"-v"}}).apply(nil); got != nil {
+		t.Errorf("nothing to run: got %v", got)
+	}
+}
+
+func TestOverrideForPath(t *testing.T) {
+	dir := t.TempDir()
+	disabled := false
+
+	setConfig(t, Config{Override: []Override{
+		{Path: "docs/**", Enabled: &disabled},
+		{Extensions: []string{".txt"}, Native: "identity"},
+		{Path: "*.conf", Language: "Nginx"},
+	}}, dir)
+
+	tests := []struct {
+		path, language string
+		native         bool
+	}{
+		{"main.go", "Go", false},
+		{"docs/main.go", "", false},
+		{"docs/api/README.md", "", false},
+		{"notes.txt", "", true},
+		{"app.conf", "Nginx", false},
+		{"sub/app.conf", "", false},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(test.path))
+
+		formatter := formatterForPath(path)
+		if test.language == "" && !test.native {
+			if formatter != nil {
+				t.Errorf("%s: got %s, want no formatter", test.path, formatter.Language)
+			}
+
+			continue
+		}
+
+		if formatter == nil {
+			t.Errorf("%s: no formatter", test.path)
+		} else if formatter.Language != test.language || (formatter.NativeFunc != nil) != test.native {
+			t.Errorf("%s: got %q (native: %v), want %q (native: %v)", test.path, formatter.Language, formatter.NativeFunc != nil, test.language, test.native)
+		}
+	}
+
+	setFlag(t, stdinFilepath, filepath.Join(dir, "docs", "main.go"))
+	if formatter, _ := formatterForStdin(); formatter != nil {
+		t.Errorf("standard input of a disabled path: got %s", formatter.Language)
+	}
+}
+
+func TestCommaList(t *testing.T) {
+	tests := []struct {
+		toml string
+		want commaList
+		err  bool
+	}{
+		{toml: `EmacsMajorModes = "go-mode, go-ts-mode,"`, want: commaList{"go-mode", "go-ts-mode"}},
+		{toml: `EmacsMajorModes = ["go-mode", "go-ts-mode"]`, want: commaList{"go-mode", "go-ts-mode"}},
+		{toml: `EmacsMajorModes = ""`, want: nil},
+		{toml: `EmacsMajorModes = 1`, err: true},
+		{toml: `EmacsMajorModes = [1, 2]`, err: true},
+	}
+
+	for _, test := range tests {
+		var c FormatterConfig
+
+		_, err := toml.Decode(test.toml, &c)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.toml, c.EmacsMajorModes)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.toml, err)
+		} else if !reflect.DeepEqual(c.EmacsMajorModes, test.want) {
+			t.Errorf("%s: got %q, want %q", test.toml, c.EmacsMajorModes, test.want)
+		}
+	}
+}
+
+//
+// High level operations
+//
+
+func TestFileList(t *testing.T) {
+	got, err := fileList(strings.NewReader("a.go\n\n  \nb.go\r\nc d.go\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"a.go", "b.go", "c d.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIsIgnoredDir(t *testing.T) {
+	dirs, patterns := IgnoreDirs, IgnoreDirPatterns
+	defer func() { IgnoreDirs, IgnoreDirPatterns = dirs, patterns }()
+
+	addIgnoreDirs([]string{"build", "web/dist"})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"src/.git", true},
+		{"src/a/node_modules", true},
+		{"src/vendor", true},
+		{"src/a/b/vendor", true},
+		{"src/a/build", true},
+		{"src/web/dist", true},
+		{"src/a/web/dist", false},
+		{"src/lib", false},
+		{"src/vendored", false},
+	}
+
+	for _, test := range tests {
+		if got := isIgnoredDir("src", filepath.FromSlash(test.path)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+//
+// Low level operations
+//
+
+// upperCommand turns standard input to uppercase, standing in for a formatter.
+var upperCommand = []string{"tr", "a-z", "A-Z"}
+
+func TestFormatValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		formatter *formatter
+		in, want  string
+	}{
+		{"front matter", &formatter{Commands: [][]string{upperCommand}, StripFrontMatter: true}, "---\ntitle: x\n---\nbody\n", "---\ntitle: x\n---\nBODY\n"},
+		{"no front matter", &formatter{Commands: [][]string{upperCommand}, StripFrontMatter: true}, "body\n", "BODY\n"},
+		{"extras", &formatter{NativeFunc: formatIdentity, Extras: map[string][]string{"upper": upperCommand}}, "body\n", "BODY\n"},
+		{"missing extra", &formatter{NativeFunc: formatIdentity, Extras: map[string][]string{"missing": {"metafmt-missing-program"}}}, "body\n", "body\n"},
+		{"failing extra", &formatter{NativeFunc: formatIdentity, Extras: map[string][]string{"failing": {"false"}}}, "body\n", "body\n"},
+		{"append newline", &formatter{NativeFunc: formatIdentity}, "body", "body\n"},
+		{"append newline, empty", &formatter{NativeFunc: formatIdentity}, "", ""},
+	}
+
+	setConfig(t, Config{AppendNewline: true, Extras: []string{"missing", "failing", "upper"}}, "")
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		if err := formatValidate(&out, strings.NewReader(test.in), "test.txt", test.formatter); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, out.String(), test.want)
+		}
+	}
+}
+
+func TestFormatValidateValidators(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	formatter := &formatter{
+		Commands:   [][]string{upperCommand},
+		Validators: [][]string{{"grep", "-q", "BODY"}, {"grep", "-q", "body"}},
+	}
+
+	var out bytes.Buffer
+	if err := formatValidate(&out, strings.NewReader("body\n"), "test.txt", formatter); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "BODY\n" {
+		t.Errorf("got %q, want the formatted output despite the failed validator", out.String())
+	}
+
+	if n := strings.Count(logs.String(), "test.txt: grep:"); n != 1 {
+		t.Errorf("got %d warnings, want one for the failed validator:\n%s", n, logs.String())
+	}
+}
+
+func TestFormatWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.txt")
+	empty := &formatter{NativeFunc: func(dst io.Writer, src io.Reader) error { return nil }}
+
+	writeFile := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readFile := func() string {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(data)
+	}
+
+	writeFile("short body\n")
+	if err := formatWrite(path, &formatter{Commands: [][]string{upperCommand}}); err != nil {
+		t.Fatal(err)
+	} else if got := readFile(); got != "SHORT BODY\n" {
+		t.Errorf("got %q", got)
+	}
+
+	writeFile("a much longer body\n")
+	if err := formatWrite(path, &formatter{Commands: [][]string{{"cut", "-c", "1-6"}}}); err != nil {
+		t.Fatal(err)
+	} else if got := readFile(); got != "a much\n" {
+		t.Errorf("shorter output: got %q", got)
+	}
+
+	if err := formatWrite(path, empty); err == nil {
+		t.Error("empty output: expected an error")
+	} else if got := readFile(); got != "a much\n" {
+		t.Errorf("empty output: the file was changed to %q", got)
+	}
+
+	*allowEmptyOutput = true
+	defer func() { *allowEmptyOutput = false }()
+
+	if err := formatWrite(path, empty); err != nil {
+		t.Error(err)
+	} else if got := readFile(); got != "" {
+		t.Errorf("empty output with -allow-empty-output: got %q", got)
+	}
+}
+
+func TestFormatTempFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		formatter *formatter
+	}{
+		{"commands", &formatter{
+			Commands: [][]string{{"sh", "-c", `tr a b < "$1" > "$1.tmp" && mv "$1.tmp" "$1"`, "sh", filenamePlaceholder}},
+			FileMode: true,
+		}},
+		{"shell", &formatter{
+			Commands: [][]string{{"tr a b <", filenamePlaceholder, ">", filenamePlaceholder + ".tmp", "&&", "mv", filenamePlaceholder + ".tmp", filenamePlaceholder}},
+			FileMode: true,
+			Shell:    true,
+		}},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		if err := test.formatter.run(&out, strings.NewReader("banana\n"), "it's a file.txt"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if out.String() != "bbnbnb\n" {
+			t.Errorf("%s: got %q, want %q", test.name, out.String(), "bbnbnb\n")
+		}
+	}
+
+	if err := formatTempFile(ioutil.Discard, strings.NewReader(""), "test.txt", [][]string{{"false"}}, false); err == nil {
+		t.Error("failing command: expected an error")
+	}
+}
+
+//
+// Reports
+//
+
+func TestWriteReportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+
+	if err := ioutil.WriteFile(path, []byte(`[{"path": "a.go"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unformatted = []checkResult{{Path: "c.go"}, {Path: "b.go", Diff: "diff"}}
+	defer func() { unformatted = nil }()
+
+	readReport := func() []checkResult {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var results []checkResult
+		if err := json.Unmarshal(data, &results); err != nil {
+			t.Fatal(err)
+		}
+
+		return results
+	}
+
+	if err := writeReportFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []checkResult{{Path: "a.go"}, {Path: "b.go", Diff: "diff"}, {Path: "c.go"}}
+	if got := readReport(); !reflect.DeepEqual(got, want) {
+		t.Errorf("appended: got %v, want %v", got, want)
+	}
+
+	*reportOverwrite = true
+	defer func() { *reportOverwrite = false }()
+
+	if err := writeReportFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []checkResult{{Path: "b.go", Diff: "diff"}, {Path: "c.go"}}
+	if got := readReport(); !reflect.DeepEqual(got, want) {
+		t.Errorf("-report-overwrite: got %v, want %v", got, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*reportOverwrite = false
+	if err := writeReportFile(path); err == nil {
+		t.Error("invalid report: expected an error")
+	}
+}
@@ -0,0 +1,429 @@
+//
+// Copyright (c) 2015 Lorenzo Villani
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+//
+// Native formatters
+//
+
+// nativeFunc is a formatter implemented in Go rather than by an external program.
+type nativeFunc func(dst io.Writer, src io.Reader) error
+
+// natives are the native formatters that .metafmt.toml overrides can select by name.
+var natives = map[string]nativeFunc{
+	"dotenv-sorted": formatDotenvSorted,
+	"identity":      formatIdentity,
+}
+
+// formatIdentity copies src unchanged, for files that are known not to need formatting.
+func formatIdentity(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+//
+// Git commit messages
+//
+
+var commitMsgFormatter = &formatter{
+	NativeFunc: formatCommitMsg,
+}
+
+var conventionalSubject = regexp.MustCompile(`^(\w+)(\([^()]*\))?(!)?\s*:\s*(.*\S)$`)
+
+// generatedSubjects start the subjects of the commit messages Git writes itself, for merges,
+// reverts and commits to be squashed by git rebase --autosquash.
+var generatedSubjects = []string{"Merge ", "Revert \"", "fixup! ", "squash! ", "amend! "}
+
+// formatCommitMsg enforces the Conventional Commits format (https://www.conventionalcommits.org)
+// on a commit message: the subject is normalized to "type(scope): description", without a
+// trailing period, and separated from the body by a blank line. Trailing whitespace is removed
+// and comment lines are left alone, as are the subjects of messages written by Git.
+func formatCommitMsg(dst io.Writer, src io.Reader) error {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), " \t\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	subject := -1
+	for i, line := range lines {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			subject = i
+			break
+		}
+	}
+
+	if subject >= 0 && !isGeneratedSubject(lines[subject]) {
+		match := conventionalSubject.FindStringSubmatch(lines[subject])
+		if match != nil {
+			match[4] = strings.TrimRight(match[4], ". \t")
+		}
+
+		if match == nil || match[4] == "" {
+			return fmt.Errorf("commit message subject %q isn't formatted as \"type(scope): description\"", lines[subject])
+		}
+
+		lines[subject] = strings.ToLower(match[1]) + match[2] + match[3] + ": " + match[4]
+
+		if next := subject + 1; next < len(lines) && lines[next] != "" && !strings.HasPrefix(lines[next], "#") {
+			lines = append(lines[:next], append([]string{""}, lines[next:]...)...)
+		}
+	}
+
+	_, err = io.WriteString(dst, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// isGeneratedSubject reports whether subject is that of a commit message written by Git.
+func isGeneratedSubject(subject string) bool {
+	for _, prefix := range generatedSubjects {
+		if strings.HasPrefix(subject, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lineEnding returns the line ending used in data, "\r\n" if it has any, "\n" otherwise.
+func lineEnding(data []byte) string {
+	if bytes.Contains(data, []byte("\r\n")) {
+		return "\r\n"
+	}
+
+	return "\n"
+}
+
+//
+// Tcl
+//
+
+const tclIndent = "    "
+
+// formatTcl reindents Tcl code by four spaces per level of nested braces, with one more level for
+// continuation lines, and removes trailing whitespace. Braces escaped by a backslash and those in
+// comments are not counted.
+func formatTcl(dst io.Writer, src io.Reader) error {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	var out strings.Builder
+
+	depth := 0
+	continued := false
+
+	for _, line := range strings.Split(strings.TrimRightFunc(string(data), unicode.IsSpace), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			out.WriteString("\n")
+			continued = false
+			continue
+		}
+
+		indent := depth - tclLeadingCloses(line)
+		if continued {
+			indent++
+		}
+
+		if indent > 0 {
+			out.WriteString(strings.Repeat(tclIndent, indent))
+		}
+
+		out.WriteString(line)
+		out.WriteString("\n")
+
+		if !strings.HasPrefix(line, "#") {
+			depth += tclBraceDelta(line)
+			if depth < 0 {
+				depth = 0
+			}
+		}
+
+		continued = strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\")
+	}
+
+	_, err = io.WriteString(dst, out.String())
+	return err
+}
+
+// tclLeadingCloses counts the closing braces at the beginning of line.
+func tclLeadingCloses(line string) int {
+	n := 0
+
+	for _, c := range line {
+		if c == '}' {
+			n++
+		} else if c != ' ' && c != '\t' {
+			break
+		}
+	}
+
+	return n
+}
+
+// tclBraceDelta returns the number of opening braces minus the number of closing braces in line.
+func tclBraceDelta(line string) int {
+	delta := 0
+
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '{':
+			delta++
+		case '}':
+			delta--
+		}
+	}
+
+	return delta
+}
+
+//
+// dotenv
+//
+
+var dotenvAssignment = regexp.MustCompile(`^(export\s+)?([A-Za-z_][A-Za-z0-9_.-]*)\s*=(.*)$`)
+
+// dotenvComment is what starts a comment after an unquoted value.
+var dotenvComment = regexp.MustCompile(`[ \t]#`)
+
+// dotenvItem is a line of a .env file, or a variable assignment and the comments right above it.
+type dotenvItem struct {
+	comments []string
+	key      string
+	lines    []string
+	removed  bool
+}
+
+// formatDotenv normalizes .env files: spaces around "=" and trailing whitespace are removed,
+// unquoted values containing spaces are double-quoted, and only the last assignment of a variable
+// defined several times is kept. Comments, blank lines and lines it doesn't understand are left
+// alone, as are quoted values spanning several lines and CRLF line endings.
+func formatDotenv(dst io.Writer, src io.Reader) error {
+	return writeDotenv(dst, src, false)
+}
+
+// formatDotenvSorted formats .env files like formatDotenv, then sorts the variables by name.
+// Comments move along with the variable right below them, other comments and lines go to the top,
+// and blank lines are removed.
+func formatDotenvSorted(dst io.Writer, src io.Reader) error {
+	return writeDotenv(dst, src, true)
+}
+
+func writeDotenv(dst io.Writer, src io.Reader, sorted bool) error {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	newline := lineEnding(data)
+	items := parseDotenv(strings.Split(strings.TrimRight(string(data), " \t\r\n"), newline))
+
+	last := make(map[string]int)
+	for i, item := range items {
+		if item.key != "" {
+			if previous, ok := last[item.key]; ok {
+				items[previous].removed = true
+			}
+
+			last[item.key] = i
+		}
+	}
+
+	var out strings.Builder
+
+	if sorted {
+		var header, comments []string
+		var entries []dotenvItem
+
+		for _, item := range items {
+			switch {
+			case item.key == "" && strings.HasPrefix(strings.TrimSpace(item.lines[0]), "#"):
+				comments = append(comments, item.lines[0])
+			case item.key == "":
+				// Comments not attached to a variable, or other lines, stay at the top
+				header = append(header, comments...)
+				if item.lines[0] != "" {
+					header = append(header, item.lines[0])
+				}
+
+				comments = nil
+			case !item.removed:
+				item.comments = comments
+				entries = append(entries, item)
+				comments = nil
+			default:
+				comments = nil
+			}
+		}
+
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+		for _, line := range header {
+			out.WriteString(line + newline)
+		}
+
+		if len(header) > 0 && len(entries) > 0 {
+			out.WriteString(newline)
+		}
+
+		for _, entry := range entries {
+			for _, line := range append(entry.comments, entry.lines...) {
+				out.WriteString(line + newline)
+			}
+		}
+
+		for _, comment := range comments {
+			out.WriteString(comment + newline)
+		}
+	} else {
+		for _, item := range items {
+			if !item.removed {
+				for _, line := range item.lines {
+					out.WriteString(line + newline)
+				}
+			}
+		}
+	}
+
+	_, err = io.WriteString(dst, out.String())
+	return err
+}
+
+// parseDotenv splits the lines of a .env file into items, normalizing assignments.
+func parseDotenv(lines []string) []dotenvItem {
+	var items []dotenvItem
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r")
+
+		match := dotenvAssignment.FindStringSubmatch(strings.TrimLeft(line, " \t"))
+		if match == nil || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			items = append(items, dotenvItem{lines: []string{line}})
+			continue
+		}
+
+		prefix := ""
+		if match[1] != "" {
+			prefix = "export "
+		}
+
+		item := dotenvItem{key: match[2]}
+
+		value := strings.TrimLeft(match[3], " \t")
+
+		if quote := dotenvQuote(value); quote != 0 {
+			if end := dotenvClosingQuote(value[1:], quote) + 1; end > 0 {
+				formatted := prefix + match[2] + "=" + value[:end+1]
+				if rest := strings.TrimSpace(value[end+1:]); rest != "" {
+					formatted += " " + rest
+				}
+
+				item.lines = []string{formatted}
+			} else {
+				// The value goes on until the line with the closing quote, kept as is but for the
+				// whitespace after the quote
+				item.lines = []string{prefix + match[2] + "=" + value}
+
+				for i+1 < len(lines) {
+					i++
+
+					if dotenvClosingQuote(lines[i], quote) >= 0 {
+						item.lines = append(item.lines, strings.TrimRight(lines[i], " \t\r"))
+						break
+					}
+
+					item.lines = append(item.lines, lines[i])
+				}
+			}
+		} else {
+			comment := ""
+			if loc := dotenvComment.FindStringIndex(match[3]); loc != nil {
+				value, comment = strings.TrimSpace(match[3][:loc[0]]), " "+match[3][loc[0]+1:]
+			}
+
+			if strings.ContainsAny(value, " \t") && !strings.ContainsAny(value, `"\`) {
+				value = `"` + value + `"`
+			}
+
+			item.lines = []string{prefix + match[2] + "=" + value + comment}
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// dotenvQuote returns the quote character value starts with, if any.
+func dotenvQuote(value string) byte {
+	if value != "" && strings.IndexByte("\"'`", value[0]) >= 0 {
+		return value[0]
+	}
+
+	return 0
+}
+
+// dotenvClosingQuote returns the index of the first quote in s that isn't escaped by a
+// backslash, or -1 if there is none.
+func dotenvClosingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote != '\'' {
+				i++
+			}
+		case quote:
+			return i
+		}
+	}
+
+	return -1
+}